@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
 
@@ -10,11 +11,24 @@ import (
 	"github.com/go-chi/chi/middleware"
 )
 
+// Full-text search needs go-sqlite3 built with FTS5, so build with
+//
+//	go build -tags sqlite_fts5
+//
+// Without it the site still runs, with a warning that search is unavailable
+// (or without one if run with -pm-search=false).
 func main() {
 	pm, err := pagemanager.New()
 	if err != nil {
 		log.Fatalln(erro.Sdump(err))
 	}
+	if flag.NArg() > 0 {
+		err = pm.RunCommand(flag.Arg(0), flag.Args()[1:])
+		if err != nil {
+			log.Fatalln(erro.Sdump(err))
+		}
+		return
+	}
 	mux := chi.NewRouter()
 	mux.Use(middleware.Compress(5))
 	mux.Use(pm.Middleware)
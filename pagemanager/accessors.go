@@ -0,0 +1,183 @@
+package pagemanager
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// jsonPath turns path into a full JSON path. Paths that do not start with $
+// are taken to be relative to the root object, i.e. "posts[0].title" is the
+// same as "$.posts[0].title".
+func jsonPath(path string) string {
+	if strings.HasPrefix(path, "$") {
+		return path
+	}
+	if strings.HasPrefix(path, "[") {
+		return "$" + path
+	}
+	return "$." + path
+}
+
+// lookupID returns the pm_templatedata ID that a typed accessor reads from:
+// the optional id argument if given, or else the current page.
+func lookupID(env map[string]interface{}, id []string) (string, bool) {
+	if len(id) > 0 {
+		return id[0], true
+	}
+	pageID, ok := env["PageID"].(string)
+	return pageID, ok
+}
+
+// lookupJSON returns the value at path in the data of id. exists reports
+// whether the path is present at all, so that a missing value (exists ==
+// false) can be told apart from an explicit null (exists == true, value ==
+// nil).
+func (pm *PageManager) lookupJSON(env map[string]interface{}, id, path string) (value interface{}, exists bool, err error) {
+	return pm.loader(env).lookup(id, jsonPath(path))
+}
+
+// hasValue reports whether path exists in the data of the current page (or
+// of id, if given). An explicit null counts as existing.
+func (pm *PageManager) hasValue(env map[string]interface{}, path string, id ...string) (bool, error) {
+	pageID, ok := lookupID(env, id)
+	if !ok {
+		return false, nil
+	}
+	_, exists, err := pm.lookupJSON(env, pageID, path)
+	return exists, err
+}
+
+// isNull reports whether path exists in the data of the current page (or of
+// id, if given) and is an explicit null.
+func (pm *PageManager) isNull(env map[string]interface{}, path string, id ...string) (bool, error) {
+	pageID, ok := lookupID(env, id)
+	if !ok {
+		return false, nil
+	}
+	value, exists, err := pm.lookupJSON(env, pageID, path)
+	return exists && value == nil, err
+}
+
+// getString returns the value at path as a string, or def if it is missing,
+// null or not a string, number or boolean.
+func (pm *PageManager) getString(env map[string]interface{}, path string, def string, id ...string) (string, error) {
+	pageID, ok := lookupID(env, id)
+	if !ok {
+		return def, nil
+	}
+	value, _, err := pm.lookupJSON(env, pageID, path)
+	if err != nil {
+		return def, err
+	}
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	default:
+		return def, nil
+	}
+}
+
+// getInt returns the value at path as an int, or def if it is missing, null
+// or cannot be converted to an int.
+func (pm *PageManager) getInt(env map[string]interface{}, path string, def int, id ...string) (int, error) {
+	pageID, ok := lookupID(env, id)
+	if !ok {
+		return def, nil
+	}
+	value, _, err := pm.lookupJSON(env, pageID, path)
+	if err != nil {
+		return def, err
+	}
+	switch value := value.(type) {
+	case float64:
+		// JSON numbers are decoded as float64, so only the ones that are
+		// integral and fit in an int are ints.
+		if value != math.Trunc(value) || value < math.MinInt64 || value >= math.MaxInt64 || float64(int(value)) != value {
+			return def, nil
+		}
+		return int(value), nil
+	case string:
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return def, nil
+		}
+		return n, nil
+	default:
+		return def, nil
+	}
+}
+
+// getBool returns the value at path as a bool, or def if it is missing, null
+// or cannot be converted to a bool.
+func (pm *PageManager) getBool(env map[string]interface{}, path string, def bool, id ...string) (bool, error) {
+	pageID, ok := lookupID(env, id)
+	if !ok {
+		return def, nil
+	}
+	value, _, err := pm.lookupJSON(env, pageID, path)
+	if err != nil {
+		return def, err
+	}
+	switch value := value.(type) {
+	case bool:
+		return value, nil
+	case float64:
+		return value != 0, nil
+	case string:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return def, nil
+		}
+		return b, nil
+	default:
+		return def, nil
+	}
+}
+
+// getMap returns the JSON object at path, or def if it is missing, null or
+// not an object. def may be nil.
+func (pm *PageManager) getMap(env map[string]interface{}, path string, def interface{}, id ...string) (map[string]interface{}, error) {
+	defmap, _ := def.(map[string]interface{})
+	if def != nil && defmap == nil {
+		return nil, fmt.Errorf("getMap: default value for %s is a %T, not a map", path, def)
+	}
+	pageID, ok := lookupID(env, id)
+	if !ok {
+		return defmap, nil
+	}
+	value, _, err := pm.lookupJSON(env, pageID, path)
+	if err != nil {
+		return defmap, err
+	}
+	if m, ok := value.(map[string]interface{}); ok {
+		return m, nil
+	}
+	return defmap, nil
+}
+
+// getList returns the JSON array at path, or def if it is missing, null or
+// not an array. def may be nil.
+func (pm *PageManager) getList(env map[string]interface{}, path string, def interface{}, id ...string) ([]interface{}, error) {
+	deflist, _ := def.([]interface{})
+	if def != nil && deflist == nil {
+		return nil, fmt.Errorf("getList: default value for %s is a %T, not a list", path, def)
+	}
+	pageID, ok := lookupID(env, id)
+	if !ok {
+		return deflist, nil
+	}
+	value, _, err := pm.lookupJSON(env, pageID, path)
+	if err != nil {
+		return deflist, err
+	}
+	if list, ok := value.([]interface{}); ok {
+		return list, nil
+	}
+	return deflist, nil
+}
@@ -0,0 +1,43 @@
+package pagemanager
+
+import (
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// staticName converts name into a path in the renderly filesystem. Names may
+// be given as /static/... URLs, as paths relative to the datafolder (e.g.
+// "pm-uploads/logo.png") or as "fsysname::path" for files in filesystems
+// added to renderly (e.g. "pagemanager::tachyons.css").
+func staticName(name string) string {
+	if strings.Contains(name, "::") {
+		return name
+	}
+	name = strings.TrimPrefix(name, "/static/")
+	return path.Clean(strings.TrimPrefix(name, "/"))
+}
+
+// fileExists reports whether name is a file (and not a folder) that
+// PageManager can serve, e.g.
+//
+//	{{ if fileExists "pm-uploads/some-image.jpg" }}
+//	<img src="/static/pm-uploads/some-image.jpg">
+//	{{ else }}
+//	<img src="/static/templates/mytheme/default-img.jpg">
+//	{{ end }}
+func (pm *PageManager) fileExists(name string) bool {
+	info, err := fs.Stat(pm.renderly.Fsys(), staticName(name))
+	return err == nil && !info.IsDir()
+}
+
+// imageFallback returns src if it exists, or fallback otherwise. It lets
+// themes show a default image until an editor uploads one, e.g.
+//
+//	<img src="{{ imageFallback "/static/pm-uploads/mytheme/hero.jpg" "/static/templates/mytheme/hero.jpg" }}">
+func (pm *PageManager) imageFallback(src, fallback string) string {
+	if pm.fileExists(src) {
+		return src
+	}
+	return fallback
+}
@@ -0,0 +1,224 @@
+package pagemanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+)
+
+const remoteAddrContextKey contextKey = "remoteAddr"
+
+// WithRemoteAddr returns a copy of ctx that records addr as the network
+// address any changes made with it came from.
+func WithRemoteAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, remoteAddrContextKey, addr)
+}
+
+func remoteAddrFromContext(ctx context.Context) string {
+	addr, _ := ctx.Value(remoteAddrContextKey).(string)
+	return addr
+}
+
+// Audit log actions.
+const (
+	AuditSave     = "save"     // a pm_templatedata draft or collection item was saved
+	AuditPublish  = "publish"  // a pm_templatedata draft was published
+	AuditSanitize = "sanitize" // published pm_templatedata was resanitized (and republished) by Resanitize
+	AuditUpload   = "upload"   // an uploaded file was written
+	AuditDelete   = "delete"   // a row or uploaded file was deleted
+	AuditImport   = "import"   // a row was written by Import
+)
+
+// AuditRecord is a single change recorded in the audit log. Targets are
+// named "{table}:{primary key}" for rows (e.g. "pm_templatedata:/about",
+// "pm_routes:/about") and "file:{path}" for uploaded files (e.g.
+// "file:pm-uploads/logo.png"). Deleting every row of a table is recorded
+// once with a "{table}:*" target. The hashes are the hex SHA-256 of the
+// target's content before and after the change, empty if it did not exist.
+type AuditRecord struct {
+	AuditID    int64     `json:"audit_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	Actor      string    `json:"actor"`
+	RemoteAddr string    `json:"remote_addr"`
+	Action     string    `json:"action"`
+	Target     string    `json:"target"`
+	BeforeHash string    `json:"before_hash"`
+	AfterHash  string    `json:"after_hash"`
+}
+
+// contentHash returns the hex SHA-256 of b, or an empty string if exists is
+// false.
+func contentHash(b []byte, exists bool) string {
+	if !exists {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// audit records a change to target in the audit log, attributing it to the
+// author and remote address of ctx. Record it in the same transaction as the
+// change itself so that the log cannot miss changes that were committed.
+func audit(ctx context.Context, db execer, action, target, beforeHash, afterHash string) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO pm_audit_log (created_at, actor, remote_addr, action, target, before_hash, after_hash) VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''))",
+		time.Now().UTC(), authorFromContext(ctx), remoteAddrFromContext(ctx), action, target, beforeHash, afterHash)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// AuditQuery filters the audit log. Zero values match everything.
+type AuditQuery struct {
+	Target   string // exact target, or a target prefix if it ends with *
+	Actor    string
+	From, To time.Time
+	Limit    int // defaults to 100
+}
+
+// QueryAuditLog returns the audit records matching q, newest first.
+func (pm *PageManager) QueryAuditLog(ctx context.Context, q AuditQuery) ([]AuditRecord, error) {
+	var conditions []string
+	var args []interface{}
+	if strings.HasSuffix(q.Target, "*") {
+		// A prefix is matched as the range of targets from prefix up to (but
+		// excluding) the first string after every string starting with it,
+		// which the target index can serve.
+		prefix := strings.TrimSuffix(q.Target, "*")
+		conditions = append(conditions, "target >= ?")
+		args = append(args, prefix)
+		if upper, ok := prefixUpperBound(prefix); ok {
+			conditions = append(conditions, "target < ?")
+			args = append(args, upper)
+		}
+	} else if q.Target != "" {
+		conditions = append(conditions, "target = ?")
+		args = append(args, q.Target)
+	}
+	if q.Actor != "" {
+		conditions = append(conditions, "actor = ?")
+		args = append(args, q.Actor)
+	}
+	if !q.From.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		conditions = append(conditions, "created_at <= ?")
+		args = append(args, q.To.UTC())
+	}
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+	query := "SELECT audit_id, created_at, COALESCE(actor, ''), COALESCE(remote_addr, ''), action, target, COALESCE(before_hash, ''), COALESCE(after_hash, '') FROM pm_audit_log"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY audit_id DESC LIMIT ?"
+	args = append(args, q.Limit)
+	rows, err := pm.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	defer rows.Close()
+	var records []AuditRecord
+	for rows.Next() {
+		var record AuditRecord
+		err = rows.Scan(&record.AuditID, &record.CreatedAt, &record.Actor, &record.RemoteAddr, &record.Action, &record.Target, &record.BeforeHash, &record.AfterHash)
+		if err != nil {
+			return records, erro.Wrap(err)
+		}
+		records = append(records, record)
+	}
+	err = rows.Err()
+	if err != nil {
+		return records, erro.Wrap(err)
+	}
+	return records, nil
+}
+
+// prefixUpperBound returns the smallest string greater than every string
+// starting with prefix, comparing bytewise like SQLite does. It returns false
+// if there is none, i.e. if prefix is empty or all 0xff bytes.
+func prefixUpperBound(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// parseAuditQuery reads an AuditQuery from the target, actor, from, to and
+// limit query parameters. from and to accept the same date formats as
+// queryRows.
+func parseAuditQuery(values map[string][]string) (AuditQuery, error) {
+	get := func(key string) string {
+		if v := values[key]; len(v) > 0 {
+			return v[len(v)-1]
+		}
+		return ""
+	}
+	q := AuditQuery{Target: get("target"), Actor: get("actor")}
+	for _, key := range []string{"from", "to"} {
+		s := get(key)
+		if s == "" {
+			continue
+		}
+		t, ok := parseDate(s)
+		if !ok {
+			return q, fmt.Errorf("%s %q is not a recognized date", key, s)
+		}
+		if key == "from" {
+			q.From = t
+		} else {
+			q.To = t
+		}
+	}
+	if s := get("limit"); s != "" {
+		var err error
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil {
+			return q, fmt.Errorf("limit %q is not a number", s)
+		}
+	}
+	return q, nil
+}
+
+// serveAudit serves the audit records matching the target, actor, from, to
+// and limit query parameters as JSON, newest first.
+func (pm *PageManager) serveAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q, err := parseAuditQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	records, err := pm.QueryAuditLog(r.Context(), q)
+	if err != nil {
+		http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+		return
+	}
+	if records == nil {
+		records = []AuditRecord{}
+	}
+	writeJSON(w, http.StatusOK, records)
+}
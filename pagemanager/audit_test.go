@@ -0,0 +1,58 @@
+package pagemanager
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestQueryAuditLogPrefix(t *testing.T) {
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	for _, target := range []string{"pm_templatedata:café/menu", "pm_templatedata:cafe", "pm_templatedata:café", "pm_templatedata;", "pm_media:café"} {
+		err := audit(ctx, pm.db, AuditSave, target, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		target string
+		want   []string
+	}{
+		{"pm_templatedata:café*", []string{"pm_templatedata:café", "pm_templatedata:café/menu"}},
+		{"pm_templatedata:*", []string{"pm_templatedata:café", "pm_templatedata:cafe", "pm_templatedata:café/menu"}},
+		{"*", []string{"pm_media:café", "pm_templatedata;", "pm_templatedata:café", "pm_templatedata:cafe", "pm_templatedata:café/menu"}},
+	}
+	for _, tt := range tests {
+		records, err := pm.QueryAuditLog(ctx, AuditQuery{Target: tt.target})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, record := range records {
+			got = append(got, record.Target)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestPrefixUpperBound(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+		ok     bool
+	}{
+		{"pm_media:", "pm_media;", true},
+		{"a\xff", "b", true},
+		{"\xff\xff", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := prefixUpperBound(tt.prefix)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("prefixUpperBound(%q) = %q, %v, want %q, %v", tt.prefix, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,654 @@
+package pagemanager
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+)
+
+// bundleVersion is the version of the bundle format written by Export.
+const bundleVersion = 1
+
+var importMaxSize = flag.Int64("pm-import-max-size", 1<<30, "maximum size in bytes of a bundle uploaded to /pm-import")
+
+// bundleTables are the tables that make up a site's content, in the order
+// they are restored (so that foreign keys are satisfied), together with
+// their primary key columns. Revisions and the search index are not part of
+// a bundle.
+var bundleTables = []struct {
+	name string
+	keys []string
+}{
+	{name: "pm_routes", keys: []string{"url"}},
+	{name: "pm_templatedata", keys: []string{"id"}},
+	{name: "pm_collections", keys: []string{"name"}},
+	{name: "pm_collection_items", keys: []string{"collection", "slug"}},
+	{name: "pm_media", keys: []string{"path"}},
+}
+
+// bundleDirs are the datafolder folders whose files are part of a bundle:
+// the uploaded files and the installed themes.
+var bundleDirs = []string{uploadsDir, "templates"}
+
+// BundleManifest describes the contents of a bundle. It is stored as
+// manifest.json at the root of the bundle, next to a data/{table}.json file
+// for every table and a files/ folder mirroring the bundled datafolder
+// folders.
+type BundleManifest struct {
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"created_at"`
+	Tables    map[string]int `json:"tables"` // number of rows per table
+	Files     []string       `json:"files"`  // relative to the datafolder
+}
+
+// Import modes.
+const (
+	// ImportMerge adds the bundled rows and files that do not exist yet,
+	// keeping (and reporting) the existing ones that conflict.
+	ImportMerge = "merge"
+	// ImportReplace deletes every existing row of the bundled tables and
+	// overwrites existing files with the bundled ones.
+	ImportReplace = "replace"
+)
+
+// ImportConflict is a bundled row or file that was not imported because it
+// already exists.
+type ImportConflict struct {
+	Table string `json:"table,omitempty"` // empty for files
+	Key   string `json:"key"`             // primary key, or file path
+}
+
+// ImportReport summarizes what Import did.
+type ImportReport struct {
+	Rows      map[string]int   `json:"rows"` // number of rows imported per table
+	Files     int              `json:"files"`
+	Conflicts []ImportConflict `json:"conflicts"`
+}
+
+func tableColumns(name string) []string {
+	for _, t := range tables {
+		if t.name != name {
+			continue
+		}
+		columns := make([]string, len(t.columns))
+		for i, c := range t.columns {
+			columns[i] = c.name
+		}
+		return columns
+	}
+	return nil
+}
+
+// Export writes every route, page data, collection, media record, uploaded
+// file and theme to w as a zip bundle that Import can restore. The rows of
+// every table are read within a single read transaction, so that they are
+// consistent with each other.
+func (pm *PageManager) Export(ctx context.Context, w io.Writer) error {
+	manifest := BundleManifest{
+		Version:   bundleVersion,
+		CreatedAt: time.Now().UTC(),
+		Tables:    make(map[string]int),
+	}
+	tx, err := pm.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	defer tx.Rollback()
+	zw := zip.NewWriter(w)
+	for _, t := range bundleTables {
+		columns := tableColumns(t.name)
+		rows, err := tx.QueryContext(ctx, "SELECT "+strings.Join(columns, ", ")+" FROM "+t.name+" ORDER BY "+strings.Join(t.keys, ", "))
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		var records []map[string]interface{}
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			dest := make([]interface{}, len(columns))
+			for i := range values {
+				dest[i] = &values[i]
+			}
+			err = rows.Scan(dest...)
+			if err != nil {
+				rows.Close()
+				return erro.Wrap(err)
+			}
+			record := make(map[string]interface{}, len(columns))
+			for i, column := range columns {
+				if b, ok := values[i].([]byte); ok {
+					values[i] = string(b)
+				}
+				record[column] = values[i]
+			}
+			records = append(records, record)
+		}
+		rows.Close()
+		err = rows.Err()
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		manifest.Tables[t.name] = len(records)
+		f, err := zw.Create("data/" + t.name + ".json")
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if records == nil {
+			records = []map[string]interface{}{}
+		}
+		err = json.NewEncoder(f).Encode(records)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	err = tx.Rollback()
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	fsys := pm.fsys
+	for _, dir := range bundleDirs {
+		err := fs.WalkDir(fsys, dir, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if name == dir && errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			src, err := fsys.Open(name)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			dst, err := zw.Create("files/" + name)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(dst, src)
+			if err != nil {
+				return err
+			}
+			manifest.Files = append(manifest.Files, name)
+			return nil
+		})
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	f, err := zw.Create("manifest.json")
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(manifest)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return zw.Close()
+}
+
+// bundleFilePath returns the datafolder path of the bundle entry name, which
+// must lie within one of the bundleDirs.
+func bundleFilePath(name string) (string, error) {
+	rel := path.Clean(strings.TrimPrefix(name, "files/"))
+	for _, dir := range bundleDirs {
+		if strings.HasPrefix(rel, dir+"/") {
+			return rel, nil
+		}
+	}
+	return "", fmt.Errorf("bundle file %q is outside of %s", name, strings.Join(bundleDirs, ", "))
+}
+
+// bundleFile is a bundled file that Import is going to write.
+type bundleFile struct {
+	name       string // relative to the datafolder
+	entry      *zip.File
+	hash       string
+	beforeHash string // the contentHash of the previous contents of name
+	existed    bool
+	skip       bool   // set if the pm_media row of name is not imported
+	backup     string // temporary copy of the previous contents of name, restored if the import fails
+	written    bool
+}
+
+// hashReader returns the contentHash of everything read from r, without
+// holding it in memory.
+func hashReader(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashZipFile(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	defer rc.Close()
+	return hashReader(rc)
+}
+
+func hashStoredFile(ctx context.Context, storage Storage, name string) (string, error) {
+	rc, err := storage.Get(ctx, name)
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	defer rc.Close()
+	return hashReader(rc)
+}
+
+// backupFile copies the contents of f.name to a temporary file, so that they
+// can be restored if the import fails.
+func (pm *PageManager) backupFile(ctx context.Context, f *bundleFile) error {
+	rc, err := pm.fileStorage(f.name).Get(ctx, f.name)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	defer rc.Close()
+	tmp, err := os.CreateTemp("", "pm-import-backup-*")
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	defer tmp.Close()
+	f.backup = tmp.Name()
+	_, err = io.Copy(tmp, rc)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return tmp.Close()
+}
+
+// writeBundleFile writes the bundled contents of f to f.name.
+func (pm *PageManager) writeBundleFile(ctx context.Context, f *bundleFile) error {
+	rc, err := f.entry.Open()
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	defer rc.Close()
+	return pm.fileStorage(f.name).Put(ctx, f.name, rc)
+}
+
+// restoreFile puts f.name back the way it was before the import: restored
+// from its backup if it existed, deleted otherwise.
+func (pm *PageManager) restoreFile(ctx context.Context, f *bundleFile) error {
+	if !f.existed {
+		return pm.deleteFile(ctx, f.name)
+	}
+	backup, err := os.Open(f.backup)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	defer backup.Close()
+	return pm.fileStorage(f.name).Put(ctx, f.name, backup)
+}
+
+// importTemplateData restores a bundled pm_templatedata row: its published
+// data and then its draft are saved with saveTemplateData like any other
+// save.
+func (pm *PageManager) importTemplateData(ctx context.Context, tx *sql.Tx, record map[string]interface{}) error {
+	id, ok := record["id"].(string)
+	if !ok {
+		return fmt.Errorf("pm_templatedata: id %v is not a string", record["id"])
+	}
+	var data, draft sql.NullString
+	for column, value := range map[string]*sql.NullString{"data": &data, "draft": &draft} {
+		switch v := record[column].(type) {
+		case nil:
+		case string:
+			*value = sql.NullString{String: v, Valid: true}
+		default:
+			return fmt.Errorf("pm_templatedata %s: %s is a %T, not a string", id, column, v)
+		}
+	}
+	if !data.Valid {
+		if !draft.Valid {
+			return nil
+		}
+		return pm.saveTemplateData(ctx, tx, id, draft.String)
+	}
+	return pm.replaceTemplateData(ctx, tx, id, data.String, draft)
+}
+
+// Import restores the bundle written by Export in r (of the given size)
+// into the datafolder, according to mode (ImportMerge or ImportReplace).
+// Rows are restored in a single transaction. Page data goes through
+// replaceTemplateData like any other save, so it is sanitized and recorded
+// in the revision history. In merge mode a pm_media row and its file are
+// imported or skipped together. Files are compared by size and hash and
+// streamed rather than read into memory. They are written last, right
+// before the transaction is committed; if writing any of them or the commit
+// fails, the files already written are restored to their previous contents
+// (or deleted if they did not exist) and the rows are rolled back.
+func (pm *PageManager) Import(ctx context.Context, r io.ReaderAt, size int64, mode string) (ImportReport, error) {
+	report := ImportReport{Rows: make(map[string]int)}
+	if mode != ImportMerge && mode != ImportReplace {
+		return report, fmt.Errorf("invalid import mode %q, must be %s or %s", mode, ImportMerge, ImportReplace)
+	}
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return report, erro.Wrap(err)
+	}
+	entries := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+	readJSON := func(name string, v interface{}) error {
+		f, ok := entries[name]
+		if !ok {
+			return fmt.Errorf("bundle has no %s", name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		defer rc.Close()
+		return json.NewDecoder(rc).Decode(v)
+	}
+	var manifest BundleManifest
+	err = readJSON("manifest.json", &manifest)
+	if err != nil {
+		return report, erro.Wrap(err)
+	}
+	if manifest.Version != bundleVersion {
+		return report, fmt.Errorf("unsupported bundle version %d", manifest.Version)
+	}
+	records := make(map[string][]map[string]interface{})
+	for _, t := range bundleTables {
+		var rows []map[string]interface{}
+		err = readJSON("data/"+t.name+".json", &rows)
+		if err != nil {
+			return report, erro.Wrap(err)
+		}
+		if len(rows) != manifest.Tables[t.name] {
+			return report, fmt.Errorf("bundle has %d %s rows, its manifest says %d", len(rows), t.name, manifest.Tables[t.name])
+		}
+		records[t.name] = rows
+	}
+	var files []*bundleFile
+	bundled := make(map[string]*bundleFile)
+	conflicted := make(map[string]bool)
+	for _, name := range manifest.Files {
+		entry, ok := entries["files/"+name]
+		if !ok {
+			return report, fmt.Errorf("bundle is missing file %s listed in its manifest", name)
+		}
+		if _, err := bundleFilePath(name); err != nil {
+			return report, erro.Wrap(err)
+		}
+		hash, err := hashZipFile(entry)
+		if err != nil {
+			return report, erro.Wrap(err)
+		}
+		storage := pm.fileStorage(name)
+		info, err := storage.Stat(ctx, name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return report, erro.Wrap(err)
+		}
+		exists := err == nil
+		var beforeHash string
+		// In merge mode an existing file of a different size conflicts
+		// without having to be read.
+		if exists && (mode == ImportReplace || info.Size == int64(entry.UncompressedSize64)) {
+			beforeHash, err = hashStoredFile(ctx, storage, name)
+			if err != nil {
+				return report, erro.Wrap(err)
+			}
+		}
+		if exists && mode == ImportMerge {
+			if beforeHash != hash {
+				report.Conflicts = append(report.Conflicts, ImportConflict{Key: name})
+				conflicted[name] = true
+			}
+			continue
+		}
+		f := &bundleFile{
+			name:       name,
+			entry:      entry,
+			hash:       hash,
+			beforeHash: beforeHash,
+			existed:    exists,
+		}
+		files = append(files, f)
+		bundled[name] = f
+	}
+	defer func() {
+		for _, f := range files {
+			if f.backup != "" {
+				os.Remove(f.backup)
+			}
+		}
+	}()
+	err = pm.withTx(ctx, func(tx *sql.Tx) error {
+		if mode == ImportReplace {
+			for i := len(bundleTables) - 1; i >= 0; i-- {
+				_, err := tx.ExecContext(ctx, "DELETE FROM "+bundleTables[i].name)
+				if err != nil {
+					return erro.Wrap(err)
+				}
+				err = audit(ctx, tx, AuditDelete, bundleTables[i].name+":*", "", "")
+				if err != nil {
+					return erro.Wrap(err)
+				}
+			}
+		}
+		for _, t := range bundleTables {
+			columns := tableColumns(t.name)
+			known := make(map[string]bool, len(columns))
+			for _, column := range columns {
+				known[column] = true
+			}
+			where := strings.Join(t.keys, " = ? AND ") + " = ?"
+			for _, record := range records[t.name] {
+				var names, placeholders []string
+				var args []interface{}
+				for column, value := range record {
+					if !known[column] {
+						return fmt.Errorf("%s: unknown column %q", t.name, column)
+					}
+					names = append(names, column)
+					placeholders = append(placeholders, "?")
+					args = append(args, value)
+				}
+				keyArgs := make([]interface{}, len(t.keys))
+				keyParts := make([]string, len(t.keys))
+				for i, key := range t.keys {
+					keyArgs[i] = record[key]
+					keyParts[i] = fmt.Sprint(record[key])
+				}
+				var exists bool
+				err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM "+t.name+" WHERE "+where+")", keyArgs...).Scan(&exists)
+				if err != nil {
+					return erro.Wrap(err)
+				}
+				// A pm_media row is skipped together with its file: an
+				// existing row keeps its existing file, and a row is not
+				// imported if its file conflicts with an existing one.
+				var mediaPath string
+				if t.name == "pm_media" {
+					mediaPath, _ = record["path"].(string)
+				}
+				if exists || conflicted[mediaPath] {
+					report.Conflicts = append(report.Conflicts, ImportConflict{Table: t.name, Key: strings.Join(keyParts, "/")})
+					if f := bundled[mediaPath]; f != nil {
+						f.skip = true
+					}
+					continue
+				}
+				if t.name == "pm_templatedata" {
+					err = pm.importTemplateData(ctx, tx, record)
+				} else {
+					_, err = tx.ExecContext(ctx, "INSERT INTO "+t.name+" ("+strings.Join(names, ", ")+") VALUES ("+strings.Join(placeholders, ", ")+")", args...)
+				}
+				if err != nil {
+					return erro.Wrap(err)
+				}
+				b, err := json.Marshal(record)
+				if err != nil {
+					return erro.Wrap(err)
+				}
+				err = audit(ctx, tx, AuditImport, t.name+":"+strings.Join(keyParts, "/"), "", contentHash(b, true))
+				if err != nil {
+					return erro.Wrap(err)
+				}
+				report.Rows[t.name]++
+			}
+		}
+		for _, f := range files {
+			if f.skip {
+				continue
+			}
+			err := audit(ctx, tx, AuditImport, "file:"+f.name, f.beforeHash, f.hash)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		for _, f := range files {
+			if f.skip {
+				continue
+			}
+			if f.existed {
+				err := pm.backupFile(ctx, f)
+				if err != nil {
+					return erro.Wrap(err)
+				}
+			}
+			err := pm.writeBundleFile(ctx, f)
+			// A failed Put may have partly written the file, so it is
+			// restored as well.
+			f.written = true
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			report.Files++
+		}
+		return nil
+	})
+	if err != nil {
+		for _, f := range files {
+			if !f.written {
+				continue
+			}
+			rerr := pm.restoreFile(ctx, f)
+			if rerr != nil {
+				log.Printf("restoring %s after a failed import: %v\n", f.name, rerr)
+			}
+		}
+		return report, erro.Wrap(err)
+	}
+	sort.Slice(report.Conflicts, func(i, j int) bool {
+		if report.Conflicts[i].Table != report.Conflicts[j].Table {
+			return report.Conflicts[i].Table < report.Conflicts[j].Table
+		}
+		return report.Conflicts[i].Key < report.Conflicts[j].Key
+	})
+	pm.routecache.Clear()
+	pm.invalidateCollections()
+	if pm.searchErr == nil {
+		err = pm.RebuildSearchIndex(ctx)
+		if err != nil {
+			return report, erro.Wrap(err)
+		}
+	}
+	return report, nil
+}
+
+// serveExport downloads the bundle of the site.
+func (pm *PageManager) serveExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// The bundle is built in a temporary file rather than in memory, and
+	// rather than streamed straight to w so that a failed export is still
+	// answered with a 500 instead of a truncated zip.
+	f, err := os.CreateTemp("", "pm-export-*.zip")
+	if err != nil {
+		http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	err = pm.Export(r.Context(), f)
+	if err != nil {
+		http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+		return
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+		return
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+		return
+	}
+	filename := "pagemanager-" + time.Now().UTC().Format("20060102-150405") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	io.Copy(w, f)
+}
+
+// serveImport imports the bundle in the request body, using the import mode
+// in the mode query parameter (merge by default), and responds with the
+// ImportReport.
+func (pm *PageManager) serveImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = ImportMerge
+	}
+	// The bundle is spooled to a temporary file rather than held in memory,
+	// since the zip reader needs random access to it.
+	f, err := os.CreateTemp("", "pm-import-*.zip")
+	if err != nil {
+		http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, io.LimitReader(r.Body, *importMaxSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if size > *importMaxSize {
+		http.Error(w, fmt.Sprintf("bundle is larger than the limit of %s", formatBytes(*importMaxSize)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	report, err := pm.Import(requestContext(r), f, size, mode)
+	if err != nil {
+		http.Error(w, erro.Sdump(err), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
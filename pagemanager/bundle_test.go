@@ -0,0 +1,92 @@
+package pagemanager
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+)
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	const name = uploadsDir + "/media/photo.png"
+	src := newTestPageManager(t)
+	_, err := src.db.Exec("INSERT INTO pm_media (media_id, path, hash, size, uploaded_at) VALUES ('m1', ?, 'hash', 8, CURRENT_TIMESTAMP)", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = src.writeFile(ctx, name, []byte("exported"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = src.db.Exec("INSERT INTO pm_templatedata (id, data) VALUES ('posts:hello', '{\"title\":\"hello\"}')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	err = src.Export(ctx, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := bytes.NewReader(buf.Bytes())
+
+	dst := newTestPageManager(t)
+	err = dst.writeFile(ctx, name, []byte("existing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readFile := func() string {
+		rc, err := dst.storage.Get(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	countMedia := func() int {
+		var n int
+		err := dst.db.QueryRow("SELECT COUNT(*) FROM pm_media WHERE path = ?", name).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// The bundled file conflicts with the existing one, so its pm_media row
+	// must not be imported either.
+	report, err := dst.Import(ctx, bundle, bundle.Size(), ImportMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ImportConflict{{Key: name}, {Table: "pm_media", Key: name}}
+	if len(report.Conflicts) != len(want) || report.Conflicts[0] != want[0] || report.Conflicts[1] != want[1] {
+		t.Errorf("merge conflicts: got %v, want %v", report.Conflicts, want)
+	}
+	if report.Rows["pm_templatedata"] != 1 || report.Rows["pm_media"] != 0 || report.Files != 0 {
+		t.Errorf("merge imported %v rows and %d files, want 1 pm_templatedata row and no files", report.Rows, report.Files)
+	}
+	if got := readFile(); got != "existing" {
+		t.Errorf("merge overwrote the existing file with %q", got)
+	}
+	if n := countMedia(); n != 0 {
+		t.Errorf("merge imported the pm_media row of a conflicting file")
+	}
+
+	report, err = dst.Import(ctx, bundle, bundle.Size(), ImportReplace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Conflicts) != 0 || report.Files != 1 {
+		t.Errorf("replace: got %v conflicts and %d files, want none and 1", report.Conflicts, report.Files)
+	}
+	if got := readFile(); got != "exported" {
+		t.Errorf("replace left the file as %q", got)
+	}
+	if n := countMedia(); n != 1 {
+		t.Errorf("replace did not import the pm_media row")
+	}
+}
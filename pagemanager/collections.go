@@ -0,0 +1,556 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+	"github.com/bokwoon95/pagemanager-data/renderly"
+)
+
+// Collection is a named set of items (e.g. blog posts) that are routed
+// automatically: URLPrefix renders IndexTemplate, and URLPrefix/{slug}
+// renders ItemTemplate for the item with that slug.
+type Collection struct {
+	Name          string `json:"name"`
+	URLPrefix     string `json:"url_prefix"` // e.g. "/blog"
+	IndexTemplate string `json:"index_template,omitempty"`
+	ItemTemplate  string `json:"item_template,omitempty"`
+}
+
+// CollectionItem is a single item of a collection. Fields holds the item's
+// data, sanitized according to the sanitize metadata of the collection's
+// item template.
+type CollectionItem struct {
+	Collection string                 `json:"collection"`
+	Slug       string                 `json:"slug"`
+	Fields     map[string]interface{} `json:"fields"`
+	CreatedAt  time.Time              `json:"created_at"`
+	UpdatedAt  time.Time              `json:"updated_at"`
+}
+
+var slugRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// URL returns the URL of the item page of slug in c.
+func (c Collection) URL(slug string) string {
+	return c.URLPrefix + "/" + slug
+}
+
+// ListCollections returns every collection, ordered by name.
+func (pm *PageManager) ListCollections() ([]Collection, error) {
+	var collections []Collection
+	rows, err := pm.db.Query("SELECT name, url_prefix, COALESCE(index_template, ''), COALESCE(item_template, '') FROM pm_collections ORDER BY name")
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c Collection
+		err = rows.Scan(&c.Name, &c.URLPrefix, &c.IndexTemplate, &c.ItemTemplate)
+		if err != nil {
+			return collections, erro.Wrap(err)
+		}
+		collections = append(collections, c)
+	}
+	err = rows.Err()
+	if err != nil {
+		return collections, erro.Wrap(err)
+	}
+	return collections, nil
+}
+
+// cachedCollections returns every collection like ListCollections, but only
+// reads them from the database the first time after invalidateCollections.
+func (pm *PageManager) cachedCollections() ([]Collection, error) {
+	pm.collectionsMu.RLock()
+	collections, loaded := pm.collections, pm.collectionsLoaded
+	pm.collectionsMu.RUnlock()
+	if loaded {
+		return collections, nil
+	}
+	pm.collectionsMu.Lock()
+	defer pm.collectionsMu.Unlock()
+	if pm.collectionsLoaded {
+		return pm.collections, nil
+	}
+	collections, err := pm.ListCollections()
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	pm.collections, pm.collectionsLoaded = collections, true
+	return collections, nil
+}
+
+// invalidateCollections clears the cache of cachedCollections. It must be
+// called after every write to pm_collections.
+func (pm *PageManager) invalidateCollections() {
+	pm.collectionsMu.Lock()
+	defer pm.collectionsMu.Unlock()
+	pm.collections, pm.collectionsLoaded = nil, false
+}
+
+// GetCollection returns the collection called name. ok is false if there is
+// no such collection.
+func (pm *PageManager) GetCollection(name string) (c Collection, ok bool, err error) {
+	query := "SELECT name, url_prefix, COALESCE(index_template, ''), COALESCE(item_template, '') FROM pm_collections WHERE name = ?"
+	err = pm.db.QueryRow(query, name).Scan(&c.Name, &c.URLPrefix, &c.IndexTemplate, &c.ItemTemplate)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, false, nil
+	}
+	if err != nil {
+		return c, false, erro.Wrap(err)
+	}
+	return c, true, nil
+}
+
+// SaveCollection creates the collection c, or updates its URL prefix and
+// templates if it already exists.
+func (pm *PageManager) SaveCollection(ctx context.Context, c Collection) error {
+	c.URLPrefix = strings.TrimRight(c.URLPrefix, "/")
+	if !slugRegexp.MatchString(c.Name) {
+		return fmt.Errorf("invalid collection name %q", c.Name)
+	}
+	if !strings.HasPrefix(c.URLPrefix, "/") {
+		return fmt.Errorf("collection %s: URL prefix %q must start with / and cannot be the site root", c.Name, c.URLPrefix)
+	}
+	err := pm.checkURLPrefix(ctx, c)
+	if err != nil {
+		return err
+	}
+	_, err = pm.db.ExecContext(ctx, `INSERT INTO pm_collections (name, url_prefix, index_template, item_template)
+		VALUES (?, ?, NULLIF(?, ''), NULLIF(?, ''))
+		ON CONFLICT (name) DO UPDATE SET
+			url_prefix = EXCLUDED.url_prefix,
+			index_template = EXCLUDED.index_template,
+			item_template = EXCLUDED.item_template`,
+		c.Name, c.URLPrefix, c.IndexTemplate, c.ItemTemplate)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	pm.invalidateCollections()
+	if pm.searchErr != nil {
+		return nil
+	}
+	// The item URLs may have changed.
+	return pm.RebuildSearchIndex(ctx)
+}
+
+// checkURLPrefix fails if the pages of c would clash with the static files,
+// the PageManager endpoints, a route or another collection.
+func (pm *PageManager) checkURLPrefix(ctx context.Context, c Collection) error {
+	first := strings.SplitN(strings.TrimPrefix(c.URLPrefix, "/"), "/", 2)[0]
+	if first == "static" || first == "restart" || strings.HasPrefix(first, "pm-") {
+		return fmt.Errorf("collection %s: URL prefix %q clashes with /%s, which is reserved by PageManager", c.Name, c.URLPrefix, first)
+	}
+	collections, err := pm.ListCollections()
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	for _, other := range collections {
+		if other.Name != c.Name && other.URLPrefix == c.URLPrefix {
+			return fmt.Errorf("collection %s: URL prefix %q is already used by collection %s", c.Name, c.URLPrefix, other.Name)
+		}
+	}
+	rows, err := pm.db.QueryContext(ctx, "SELECT url FROM pm_routes WHERE url = ? OR substr(url, 1, ?) = ?", c.URLPrefix, len(c.URLPrefix)+1, c.URLPrefix+"/")
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var url string
+		err = rows.Scan(&url)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		if _, _, ok := matchCollectionPath([]Collection{c}, url); ok {
+			return fmt.Errorf("collection %s: URL prefix %q clashes with the route %s", c.Name, c.URLPrefix, url)
+		}
+	}
+	return rows.Err()
+}
+
+// ListItems returns every item of collection, newest first.
+func (pm *PageManager) ListItems(collection string) ([]CollectionItem, error) {
+	var items []CollectionItem
+	query := "SELECT collection, slug, fields, created_at, updated_at FROM pm_collection_items WHERE collection = ? ORDER BY created_at DESC, slug"
+	rows, err := pm.db.Query(query, collection)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil {
+			return items, erro.Wrap(err)
+		}
+		items = append(items, item)
+	}
+	err = rows.Err()
+	if err != nil {
+		return items, erro.Wrap(err)
+	}
+	return items, nil
+}
+
+// GetItem returns the item of collection with the given slug. ok is false if
+// there is no such item.
+func (pm *PageManager) GetItem(collection, slug string) (item CollectionItem, ok bool, err error) {
+	query := "SELECT collection, slug, fields, created_at, updated_at FROM pm_collection_items WHERE collection = ? AND slug = ?"
+	item, err = scanItem(pm.db.QueryRow(query, collection, slug))
+	if errors.Is(err, sql.ErrNoRows) {
+		return item, false, nil
+	}
+	if err != nil {
+		return item, false, erro.Wrap(err)
+	}
+	return item, true, nil
+}
+
+func scanItem(row interface{ Scan(...interface{}) error }) (CollectionItem, error) {
+	var item CollectionItem
+	var fields sql.NullString
+	var createdAt, updatedAt sql.NullTime
+	err := row.Scan(&item.Collection, &item.Slug, &fields, &createdAt, &updatedAt)
+	if err != nil {
+		return item, err
+	}
+	item.CreatedAt, item.UpdatedAt = createdAt.Time, updatedAt.Time
+	if fields.Valid && fields.String != "" {
+		err = json.Unmarshal([]byte(fields.String), &item.Fields)
+		if err != nil {
+			return item, erro.Wrap(err)
+		}
+	}
+	return item, nil
+}
+
+// SaveItem creates or replaces the item with the collection and slug of
+// item. Its fields are sanitized like page data, according to the policies
+// of the collection's item template.
+func (pm *PageManager) SaveItem(ctx context.Context, item CollectionItem) error {
+	if !slugRegexp.MatchString(item.Slug) {
+		return fmt.Errorf("invalid slug %q", item.Slug)
+	}
+	c, ok, err := pm.GetCollection(item.Collection)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if !ok {
+		return fmt.Errorf("no such collection %q", item.Collection)
+	}
+	var policies map[string]string
+	if c.ItemTemplate != "" {
+		policies, err = pm.templatePolicies(c.ItemTemplate)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	if item.Fields == nil {
+		item.Fields = make(map[string]interface{})
+	}
+	fields, err := pm.sanitizeValue(item.Fields, "", policies)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	now := time.Now().UTC()
+	target := "pm_collection_items:" + item.Collection + "/" + item.Slug
+	return pm.withTx(ctx, func(tx *sql.Tx) error {
+		var before sql.NullString
+		err := tx.QueryRowContext(ctx, "SELECT fields FROM pm_collection_items WHERE collection = ? AND slug = ?", item.Collection, item.Slug).Scan(&before)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return erro.Wrap(err)
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO pm_collection_items (collection, slug, fields, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (collection, slug) DO UPDATE SET
+				fields = EXCLUDED.fields,
+				updated_at = EXCLUDED.updated_at`,
+			item.Collection, item.Slug, string(b), now, now)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		err = audit(ctx, tx, AuditSave, target, contentHash([]byte(before.String), before.Valid), contentHash(b, true))
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return pm.indexItem(ctx, tx, c, item.Slug)
+	})
+}
+
+// DeleteItem deletes the item of collection with the given slug.
+func (pm *PageManager) DeleteItem(ctx context.Context, collection, slug string) error {
+	c, ok, err := pm.GetCollection(collection)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if !ok {
+		return nil
+	}
+	return pm.withTx(ctx, func(tx *sql.Tx) error {
+		var before sql.NullString
+		err := tx.QueryRowContext(ctx, "SELECT fields FROM pm_collection_items WHERE collection = ? AND slug = ?", collection, slug).Scan(&before)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM pm_collection_items WHERE collection = ? AND slug = ?", collection, slug)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		err = audit(ctx, tx, AuditDelete, "pm_collection_items:"+collection+"/"+slug, contentHash([]byte(before.String), before.Valid), "")
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return pm.indexItem(ctx, tx, c, slug)
+	})
+}
+
+// itemRow returns item as a row for templates: its fields, together with
+// its slug, url, created_at and updated_at (which take precedence over
+// fields of the same name).
+func itemRow(c Collection, item CollectionItem) map[string]interface{} {
+	row := make(map[string]interface{}, len(item.Fields)+4)
+	for key, value := range item.Fields {
+		row[key] = value
+	}
+	row["slug"] = item.Slug
+	row["url"] = c.URL(item.Slug)
+	row["created_at"] = item.CreatedAt.Format(time.RFC3339)
+	row["updated_at"] = item.UpdatedAt.Format(time.RFC3339)
+	return row
+}
+
+// listItems returns the items of collection as rows, filtered, sorted and
+// paginated with the same options as queryRows (except id). Items are
+// ordered newest first unless sorted otherwise.
+//
+// e.g. {{ $posts := listItems .Env "blog" "filter.draft" false "perPage" 10 }}
+func (pm *PageManager) listItems(env map[string]interface{}, collection string, args ...interface{}) (RowsPage, error) {
+	query, err := parseRowsQuery(args)
+	if err != nil {
+		return RowsPage{}, err
+	}
+	if query.id != "" {
+		return RowsPage{}, fmt.Errorf("listItems: the id option is not supported")
+	}
+	c, ok, err := pm.GetCollection(collection)
+	if err != nil || !ok {
+		return RowsPage{Page: 1, TotalPages: 1}, err
+	}
+	items, err := pm.ListItems(collection)
+	if err != nil {
+		return RowsPage{}, err
+	}
+	rows := make([]interface{}, len(items))
+	for i, item := range items {
+		rows[i] = itemRow(c, item)
+	}
+	return query.apply(env, rows), nil
+}
+
+// getItem returns the item of collection with the given slug as a row (see
+// listItems), or nil if there is no such item. Item pages can get their own
+// item from .Env.Item instead.
+func (pm *PageManager) getItem(env map[string]interface{}, collection, slug string) (map[string]interface{}, error) {
+	c, ok, err := pm.GetCollection(collection)
+	if err != nil || !ok {
+		return nil, err
+	}
+	item, ok, err := pm.GetItem(collection, slug)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return itemRow(c, item), nil
+}
+
+// matchCollection returns the collection whose index page or item pages
+// path belongs to. slug is empty for the index page.
+func (pm *PageManager) matchCollection(path string) (c Collection, slug string, ok bool, err error) {
+	collections, err := pm.cachedCollections()
+	if err != nil {
+		return c, "", false, erro.Wrap(err)
+	}
+	c, slug, ok = matchCollectionPath(collections, path)
+	return c, slug, ok, nil
+}
+
+// matchCollectionPath is matchCollection over the given collections.
+func matchCollectionPath(collections []Collection, path string) (c Collection, slug string, ok bool) {
+	path = strings.TrimRight(path, "/")
+	for _, c := range collections {
+		if path == c.URLPrefix {
+			return c, "", true
+		}
+		rest := strings.TrimPrefix(path, c.URLPrefix+"/")
+		if rest != path && !strings.Contains(rest, "/") {
+			return c, rest, true
+		}
+	}
+	return c, "", false
+}
+
+// serveCollectionPage renders the collection index page or item page at
+// r.URL.Path, if there is one. It reports whether it served the request.
+// Item pages get the item in .Env.Item and the collection in
+// .Env.Collection.
+func (pm *PageManager) serveCollectionPage(w http.ResponseWriter, r *http.Request) (served bool, err error) {
+	c, slug, ok, err := pm.matchCollection(r.URL.Path)
+	if err != nil || !ok {
+		return false, err
+	}
+	env := map[string]interface{}{"Collection": c.Name}
+	if slug == "" {
+		if c.IndexTemplate == "" {
+			return false, nil
+		}
+		return true, pm.renderTemplate(w, r, c.IndexTemplate, false, renderly.HTMLEnv(env))
+	}
+	if c.ItemTemplate == "" {
+		return false, nil
+	}
+	item, ok, err := pm.GetItem(c.Name, slug)
+	if err != nil {
+		return false, erro.Wrap(err)
+	}
+	if !ok {
+		pm.notfound.ServeHTTP(w, r)
+		return true, nil
+	}
+	env["Item"] = itemRow(c, item)
+	return true, pm.renderTemplate(w, r, c.ItemTemplate, false, renderly.HTMLEnv(env))
+}
+
+// indexItem replaces the search index entry of the item page of slug in c
+// with the text of its fields. It does nothing if search is unavailable.
+func (pm *PageManager) indexItem(ctx context.Context, tx *sql.Tx, c Collection, slug string) error {
+	if pm.searchErr != nil || c.ItemTemplate == "" {
+		return nil
+	}
+	url := c.URL(slug)
+	_, err := tx.ExecContext(ctx, "DELETE FROM pm_search WHERE url = ?", url)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	var fields sql.NullString
+	err = tx.QueryRowContext(ctx, "SELECT fields FROM pm_collection_items WHERE collection = ? AND slug = ?", c.Name, slug).Scan(&fields)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	var value interface{}
+	if fields.Valid && fields.String != "" {
+		err = json.Unmarshal([]byte(fields.String), &value)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	return insertSearchText(ctx, tx, url, appendText(nil, value))
+}
+
+// serveCollections serves the collections API:
+//
+//	GET    /pm-collections               list collections
+//	PUT    /pm-collections/{name}        create or update a collection
+//	GET    /pm-collections/{name}        list the items of a collection
+//	GET    /pm-collections/{name}/{slug} get an item
+//	PUT    /pm-collections/{name}/{slug} create or replace an item from its fields
+//	DELETE /pm-collections/{name}/{slug} delete an item
+func (pm *PageManager) serveCollections(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/pm-collections"), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "":
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		collections, err := pm.ListCollections()
+		if err != nil {
+			http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, collections)
+	case len(parts) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			items, err := pm.ListItems(parts[0])
+			if err != nil {
+				http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, items)
+		case http.MethodPut:
+			var c Collection
+			err := json.NewDecoder(r.Body).Decode(&c)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c.Name = parts[0]
+			err = pm.SaveCollection(ctx, c)
+			if err != nil {
+				http.Error(w, erro.Sdump(err), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, http.StatusOK, c)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	case len(parts) == 2:
+		switch r.Method {
+		case http.MethodGet:
+			item, ok, err := pm.GetItem(parts[0], parts[1])
+			if err != nil {
+				http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(w, http.StatusOK, item)
+		case http.MethodPut:
+			item := CollectionItem{Collection: parts[0], Slug: parts[1]}
+			err := json.NewDecoder(r.Body).Decode(&item.Fields)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = pm.SaveItem(ctx, item)
+			if err != nil {
+				http.Error(w, erro.Sdump(err), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			err := pm.DeleteItem(ctx, parts[0], parts[1])
+			if err != nil {
+				http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
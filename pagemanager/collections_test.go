@@ -0,0 +1,31 @@
+package pagemanager
+
+import "testing"
+
+func TestMatchCollectionPath(t *testing.T) {
+	collections := []Collection{
+		{Name: "posts", URLPrefix: "/blog"},
+		{Name: "recipes", URLPrefix: "/food/recipes"},
+	}
+	tests := []struct {
+		path       string
+		collection string // empty if path matches no collection
+		slug       string
+	}{
+		{"/blog", "posts", ""},
+		{"/blog/", "posts", ""},
+		{"/blog/hello-world", "posts", "hello-world"},
+		{"/blog/hello-world/", "posts", "hello-world"},
+		{"/blog/2021/hello-world", "", ""},
+		{"/blogger", "", ""},
+		{"/food", "", ""},
+		{"/food/recipes/soup", "recipes", "soup"},
+		{"/", "", ""},
+	}
+	for _, tt := range tests {
+		c, slug, ok := matchCollectionPath(collections, tt.path)
+		if ok != (tt.collection != "") || c.Name != tt.collection || slug != tt.slug {
+			t.Errorf("matchCollectionPath(%q) = %q, %q, %v, want %q, %q", tt.path, c.Name, slug, ok, tt.collection, tt.slug)
+		}
+	}
+}
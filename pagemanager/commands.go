@@ -0,0 +1,211 @@
+package pagemanager
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+)
+
+// RunCommand runs the PageManager command called name with the given
+// arguments, printing its output to stdout. Changes made by commands are
+// attributed to the user running them.
+func (pm *PageManager) RunCommand(name string, args []string) error {
+	ctx := context.Background()
+	if u, err := user.Current(); err == nil {
+		ctx = WithAuthor(ctx, u.Username)
+	}
+	switch name {
+	case "lint":
+		issues, err := pm.Lint()
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for _, issue := range issues {
+			fmt.Println(issue)
+		}
+		if len(issues) > 0 {
+			return fmt.Errorf("lint: %d issue(s) found", len(issues))
+		}
+		return nil
+	case "revisions":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: revisions <id>")
+		}
+		revisions, err := pm.ListRevisions(args[0])
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for _, revision := range revisions {
+			fmt.Printf("%d\t%s\t%s\n", revision.RevisionID, revision.CreatedAt.Format(time.RFC3339), revision.Author)
+		}
+		return nil
+	case "restore":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: restore <revision_id>")
+		}
+		revisionID, err := parseRevisionID(args[0])
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return pm.RestoreRevision(ctx, revisionID)
+	case "publish":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: publish <id>...")
+		}
+		return pm.Publish(ctx, args...)
+	case "sanitize":
+		changed, err := pm.Resanitize(ctx)
+		for _, id := range changed {
+			fmt.Println(id)
+		}
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return nil
+	case "reindex":
+		return pm.RebuildSearchIndex(ctx)
+	case "search":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: search <query>")
+		}
+		results, err := pm.Search(ctx, strings.Join(args, " "), 0)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for _, result := range results {
+			fmt.Printf("%s\t%s\n", result.URL, result.Snippet)
+		}
+		return nil
+	case "export":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: export <file.zip>")
+		}
+		f, err := os.Create(args[0])
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		err = pm.Export(ctx, f)
+		if err != nil {
+			f.Close()
+			return erro.Wrap(err)
+		}
+		return f.Close()
+	case "import":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("usage: import <file.zip> [%s|%s]", ImportMerge, ImportReplace)
+		}
+		mode := ImportMerge
+		if len(args) == 2 {
+			mode = args[1]
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		report, err := pm.Import(ctx, f, info.Size(), mode)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for _, table := range bundleTables {
+			fmt.Printf("%s: %d rows imported\n", table.name, report.Rows[table.name])
+		}
+		fmt.Printf("files: %d imported\n", report.Files)
+		for _, conflict := range report.Conflicts {
+			if conflict.Table == "" {
+				fmt.Printf("conflict: file %s already exists, kept\n", conflict.Key)
+			} else {
+				fmt.Printf("conflict: %s %s already exists, kept\n", conflict.Table, conflict.Key)
+			}
+		}
+		return nil
+	case "gc":
+		flagset := flag.NewFlagSet("gc", flag.ContinueOnError)
+		dryRun := flagset.Bool("dry-run", false, "only report what would be deleted")
+		gracePeriod := flagset.Duration("grace-period", *gcGracePeriod, "how old an unreferenced upload must be before it is deleted")
+		err := flagset.Parse(args)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		report, err := pm.CollectGarbage(ctx, GCOptions{GracePeriod: *gracePeriod, DryRun: *dryRun})
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for _, orphan := range report.Orphans {
+			status := "kept (within grace period)"
+			switch {
+			case orphan.Deleted:
+				status = "deleted"
+			case orphan.Expired:
+				status = "would be deleted"
+			}
+			fmt.Printf("orphan: %s\t%d bytes\t%s\t%s\n", orphan.Path, orphan.Size, orphan.ModTime.Format(time.RFC3339), status)
+		}
+		for _, name := range report.StaleVariants {
+			if *dryRun {
+				fmt.Printf("stale variant: %s\twould be deleted\n", name)
+			} else {
+				fmt.Printf("stale variant: %s\tdeleted\n", name)
+			}
+		}
+		fmt.Printf("%d uploads, %d referenced, %d orphaned\n", report.Uploads, report.Referenced, len(report.Orphans))
+		return nil
+	case "links":
+		report, err := pm.CheckLinks(ctx, nil)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for _, link := range report.Broken {
+			detail := link.Problem
+			if link.Status != 0 {
+				detail += fmt.Sprintf(" (%d)", link.Status)
+			}
+			if len(link.Chain) > 0 {
+				detail += ": " + strings.Join(link.Chain, " -> ")
+			}
+			fmt.Printf("%s\t%s\t%s\n", link.Source, link.URL, detail)
+		}
+		for _, message := range report.Errors {
+			fmt.Printf("error: %s\n", message)
+		}
+		fmt.Printf("%d pages, %d links, %d broken\n", report.Pages, report.Links, len(report.Broken))
+		if len(report.Broken) > 0 {
+			return fmt.Errorf("links: %d broken link(s) found", len(report.Broken))
+		}
+		return nil
+	case "audit":
+		var values url.Values
+		if len(args) > 0 {
+			var err error
+			values, err = url.ParseQuery(strings.Join(args, "&"))
+			if err != nil {
+				return fmt.Errorf("usage: audit [target=...] [actor=...] [from=...] [to=...] [limit=...]")
+			}
+		}
+		q, err := parseAuditQuery(values)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		records, err := pm.QueryAuditLog(ctx, q)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for _, record := range records {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", record.CreatedAt.Format(time.RFC3339), record.Actor, record.RemoteAddr, record.Action, record.Target)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
@@ -0,0 +1,207 @@
+package pagemanager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/bokwoon95/erro"
+)
+
+// cropFieldPrefix prefixes the /pm-save multipart form values that hold the
+// JSON CropParams of an upload URL, e.g. "pm-crop:/static/pm-uploads/hero.jpg".
+const cropFieldPrefix = "pm-crop:"
+
+// keepMetadataFieldPrefix prefixes the /pm-save multipart form values that
+// opt an upload URL out of metadata stripping, e.g.
+// "pm-keep-metadata:/static/pm-uploads/hero.jpg" set to "true".
+const keepMetadataFieldPrefix = "pm-keep-metadata:"
+
+// CropParams describes how the editor cropped an image. The original is
+// first put upright (according to its EXIF orientation) and rotated, then
+// the crop rectangle (in pixels of the rotated original) is cut out and
+// scaled to the output size.
+type CropParams struct {
+	X            int `json:"x"`
+	Y            int `json:"y"`
+	Width        int `json:"width"`
+	Height       int `json:"height"`
+	Rotate       int `json:"rotate"` // clockwise, in degrees (a multiple of 90)
+	OutputWidth  int `json:"output_width"`
+	OutputHeight int `json:"output_height"`
+}
+
+func (crop CropParams) validate(rawurl string) *UploadError {
+	var problem string
+	switch {
+	case crop.Rotate%90 != 0:
+		problem = "rotation must be a multiple of 90 degrees"
+	case crop.X < 0 || crop.Y < 0 || crop.Width <= 0 || crop.Height <= 0:
+		problem = "crop rectangle must have a positive size and lie inside the image"
+	case crop.OutputWidth <= 0 || crop.OutputHeight <= 0:
+		problem = "output size must be positive"
+	case (*uploadMaxWidth > 0 && crop.OutputWidth > *uploadMaxWidth) || (*uploadMaxHeight > 0 && crop.OutputHeight > *uploadMaxHeight):
+		problem = fmt.Sprintf("output size %dx%d is larger than the limit of %dx%d", crop.OutputWidth, crop.OutputHeight, *uploadMaxWidth, *uploadMaxHeight)
+	default:
+		return nil
+	}
+	return &UploadError{Status: http.StatusUnprocessableEntity, Code: "invalid_crop", Message: problem, File: rawurl}
+}
+
+// CropUpload crops an original image according to crop and stores the
+// result at the upload URL rawurl, which must name a .jpg or .png file.
+//
+// If original is not nil it is added to the media library as the new
+// original. Otherwise the original that the image at rawurl was previously
+// cropped from is cropped again, so that re-cropping never loses quality; if
+// the image was never cropped, its current file becomes the original.
+// Metadata is stripped from a new original unless keepMetadata is set; the
+// cropped image never has any, since it is re-encoded.
+//
+// If the upload breaks the upload rules, the returned error is an
+// *UploadError.
+func (pm *PageManager) CropUpload(ctx context.Context, rawurl, originalName string, original io.Reader, crop CropParams, keepMetadata bool) (Media, error) {
+	batch := &uploadBatch{}
+	u, err := pm.stageCrop(ctx, batch, rawurl, originalName, original, crop, keepMetadata)
+	if err != nil {
+		return Media{}, err
+	}
+	err = pm.storeUploads(ctx, batch, nil)
+	if err != nil {
+		return Media{}, erro.Wrap(err)
+	}
+	return u.media, nil
+}
+
+// stageCrop is the part of CropUpload that validates the crop and computes
+// the cropped image, adding it (and a new original) to batch.
+func (pm *PageManager) stageCrop(ctx context.Context, batch *uploadBatch, rawurl, originalName string, original io.Reader, crop CropParams, keepMetadata bool) (*stagedUpload, error) {
+	name, err := uploadPath(rawurl)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	if uerr := checkUploadName(rawurl, name); uerr != nil {
+		return nil, uerr
+	}
+	ext := strings.ToLower(path.Ext(name))
+	if ext != ".jpg" && ext != ".jpeg" && ext != ".png" {
+		return nil, &UploadError{
+			Status:  http.StatusUnsupportedMediaType,
+			Code:    "type_not_allowed",
+			Message: "cropped images can only be saved as .jpg or .png files",
+			File:    rawurl,
+		}
+	}
+	if uerr := crop.validate(rawurl); uerr != nil {
+		return nil, uerr
+	}
+	orig, err := pm.stageCropOriginal(ctx, batch, rawurl, name, originalName, original, keepMetadata)
+	if err != nil {
+		if uerr, ok := err.(*UploadError); ok {
+			return nil, uerr
+		}
+		return nil, erro.Wrap(err)
+	}
+	b, origName := orig.b, orig.originalName
+	if orig.stored {
+		var exists bool
+		b, exists, err = readStorage(ctx, pm.storage, orig.media.Path)
+		if err != nil {
+			return nil, erro.Wrap(err)
+		}
+		if !exists {
+			return nil, fmt.Errorf("original %s of %s is missing", orig.media.Path, rawurl)
+		}
+		origName = orig.media.OriginalName
+	}
+	src, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, &UploadError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "invalid_image",
+			Message: "original image could not be read: " + err.Error(),
+			File:    rawurl,
+		}
+	}
+	src = rotateImage(orientImage(src, jpegOrientation(b)), crop.Rotate)
+	bounds := src.Bounds()
+	// A crop rectangle that does not lie entirely within the image is
+	// rejected rather than clamped, since clamping would silently change the
+	// aspect ratio of the crop.
+	rect := image.Rect(crop.X, crop.Y, crop.X+crop.Width, crop.Y+crop.Height).Add(bounds.Min)
+	if rect.Empty() || !rect.In(bounds) {
+		return nil, &UploadError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "invalid_crop",
+			Message: fmt.Sprintf("crop rectangle %dx%d at (%d, %d) does not lie within the %dx%d image", crop.Width, crop.Height, crop.X, crop.Y, bounds.Dx(), bounds.Dy()),
+			File:    rawurl,
+		}
+	}
+	cropped := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), src, rect.Min, draw.Src)
+	out := scaleImage(cropped, crop.OutputWidth, crop.OutputHeight)
+	buf := &bytes.Buffer{}
+	if ext == ".png" {
+		err = png.Encode(buf, out)
+	} else {
+		err = jpeg.Encode(buf, out, &jpeg.Options{Quality: *imageQuality})
+	}
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	u, err := pm.stage(ctx, batch, name, origName, buf.Bytes(), uploadOptions{
+		originalID:       orig.media.ID,
+		crop:             &crop,
+		metadataStripped: true,
+	})
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	if !orig.stored {
+		u.original = orig
+	}
+	return u, nil
+}
+
+// stageCropOriginal returns the media library original that the upload at
+// name should be cropped from, see CropUpload. A new original is added to
+// batch.
+func (pm *PageManager) stageCropOriginal(ctx context.Context, batch *uploadBatch, rawurl, name, originalName string, original io.Reader, keepMetadata bool) (*stagedUpload, error) {
+	if original != nil {
+		return pm.stageMedia(ctx, batch, originalName, original, keepMetadata)
+	}
+	current, ok, err := pm.GetMediaByPath(ctx, name)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	if ok && current.OriginalID != "" {
+		orig, ok, err := pm.GetMedia(ctx, current.OriginalID)
+		if err != nil {
+			return nil, erro.Wrap(err)
+		}
+		if ok {
+			return &stagedUpload{name: orig.Path, media: orig, stored: true}, nil
+		}
+	}
+	b, exists, err := readStorage(ctx, pm.storage, name)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	if !exists {
+		return nil, &UploadError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "no_original",
+			Message: "there is no image to crop, upload one first",
+			File:    rawurl,
+		}
+	}
+	return pm.stageMedia(ctx, batch, path.Base(name), bytes.NewReader(b), keepMetadata)
+}
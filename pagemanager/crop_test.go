@@ -0,0 +1,35 @@
+package pagemanager
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestCropUploadBounds(t *testing.T) {
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	original := encodePNG(t, 10, 10)
+	tests := []struct {
+		crop CropParams
+		code string // empty if the crop is valid
+	}{
+		{CropParams{X: 0, Y: 0, Width: 10, Height: 10, OutputWidth: 5, OutputHeight: 5}, ""},
+		{CropParams{X: 5, Y: 5, Width: 5, Height: 5, OutputWidth: 5, OutputHeight: 5}, ""},
+		{CropParams{X: 5, Y: 0, Width: 10, Height: 10, OutputWidth: 5, OutputHeight: 5}, "invalid_crop"},
+		{CropParams{X: 0, Y: 9, Width: 4, Height: 2, OutputWidth: 4, OutputHeight: 2}, "invalid_crop"},
+		{CropParams{X: 20, Y: 20, Width: 4, Height: 4, OutputWidth: 4, OutputHeight: 4}, "invalid_crop"},
+	}
+	for _, tt := range tests {
+		_, err := pm.CropUpload(ctx, "/static/"+uploadsDir+"/hero.png", "hero.png", bytes.NewReader(original), tt.crop, false)
+		var code string
+		if uerr, ok := err.(*UploadError); ok {
+			code = uerr.Code
+		} else if err != nil {
+			t.Fatalf("%+v: %v", tt.crop, err)
+		}
+		if code != tt.code {
+			t.Errorf("%+v: got %v, want code %q", tt.crop, err, tt.code)
+		}
+	}
+}
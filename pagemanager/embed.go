@@ -4,7 +4,7 @@ package pagemanager
 
 import "embed"
 
-//go:embed *.css *.js
+//go:embed *.css *.js *.html
 var files embed.FS
 
 func init() {
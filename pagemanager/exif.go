@@ -0,0 +1,421 @@
+package pagemanager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+)
+
+// jpegOrientation returns the EXIF orientation (1 to 8) of the JPEG b, or 1
+// if b is not a JPEG or has no orientation. Browsers display (and the editor
+// crops) images in their EXIF orientation, so images must be put in that
+// orientation before they are cropped on the server.
+func jpegOrientation(b []byte) int {
+	// b may be truncated (see srcset), so the segments read before an error
+	// are still looked at.
+	segments, _, _ := jpegSegments(b)
+	for _, segment := range segments {
+		if data := segment.data(); segment.marker == 0xE1 && len(data) >= 6 && string(data[:6]) == "Exif\x00\x00" {
+			return tiffOrientation(data[6:])
+		}
+	}
+	return 1
+}
+
+// jpegSegment is a marker segment of a JPEG.
+type jpegSegment struct {
+	marker byte
+	b      []byte // the whole segment, starting with 0xFF and the marker
+}
+
+// data returns the contents of the segment after its length, or nil for a
+// marker without a length.
+func (segment jpegSegment) data() []byte {
+	if len(segment.b) < 4 {
+		return nil
+	}
+	return segment.b[4:]
+}
+
+// jpegSegments returns the marker segments of the JPEG b that come before
+// its image data, and the offset of the start of scan (SOS) marker where the
+// image data begins (or of the end of image marker if there is no scan). If
+// b is not a valid JPEG, it returns the segments read before the problem was
+// found with an error. The 0xFF fill bytes that may precede any marker are
+// skipped.
+func jpegSegments(b []byte) (segments []jpegSegment, scan int, err error) {
+	errInvalid := errors.New("invalid JPEG")
+	if !bytes.HasPrefix(b, []byte("\xFF\xD8")) {
+		return nil, 0, errInvalid
+	}
+	for i := 2; ; {
+		if i+2 > len(b) || b[i] != 0xFF {
+			return segments, 0, errInvalid
+		}
+		for i+2 < len(b) && b[i+1] == 0xFF {
+			i++
+		}
+		marker := b[i+1]
+		switch {
+		case marker == 0xDA || marker == 0xD9:
+			return segments, i, nil
+		// Markers without a length.
+		case marker == 0xD8 || marker == 0x01 || (0xD0 <= marker && marker <= 0xD7):
+			segments = append(segments, jpegSegment{marker: marker, b: b[i : i+2]})
+			i += 2
+			continue
+		}
+		if i+4 > len(b) {
+			return segments, 0, errInvalid
+		}
+		length := int(binary.BigEndian.Uint16(b[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(b) {
+			return segments, 0, errInvalid
+		}
+		segments = append(segments, jpegSegment{marker: marker, b: b[i:end]})
+		i = end
+	}
+}
+
+// isICCSegment reports whether segment is an APP2 segment holding (part of)
+// an ICC color profile.
+func isICCSegment(segment jpegSegment) bool {
+	return segment.marker == 0xE2 && bytes.HasPrefix(segment.data(), []byte("ICC_PROFILE\x00"))
+}
+
+// tiffOrientation returns the Orientation tag (0x0112) of the first IFD of
+// the TIFF structure that EXIF data is stored in, or 1 if it has none.
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != 0x0112 {
+			continue
+		}
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 1
+		}
+		return orientation
+	}
+	return 1
+}
+
+// orientImage returns src transformed from the EXIF orientation to the
+// upright orientation (1). The orientations are:
+//
+//	1: upright               5: transposed
+//	2: flipped horizontally  6: rotated 90° clockwise to display
+//	3: rotated 180°          7: transversed
+//	4: flipped vertically    8: rotated 90° counterclockwise to display
+func orientImage(src image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	sb := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, sb.Dx(), sb.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, sb.Min, draw.Src)
+	w, h := sb.Dx(), sb.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], rgba.Pix[rgba.PixOffset(sx, sy):rgba.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// rotateImage rotates src clockwise by degrees, which must be a multiple of
+// 90.
+func rotateImage(src image.Image, degrees int) image.Image {
+	switch ((degrees % 360) + 360) % 360 {
+	case 90:
+		return orientImage(src, 6)
+	case 180:
+		return orientImage(src, 3)
+	case 270:
+		return orientImage(src, 8)
+	}
+	return src
+}
+
+// metadataJPEGMarkers are the JPEG segments that stripMetadata removes:
+// APP1 (EXIF and XMP), APP13 (Photoshop IPTC) and COM (comments). APP2,
+// which holds the ICC color profile, is kept.
+var metadataJPEGMarkers = map[byte]bool{0xE1: true, 0xED: true, 0xFE: true}
+
+// metadataPNGChunks are the PNG chunks that stripMetadata removes. XMP is
+// stored in an iTXt chunk.
+var metadataPNGChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+// metadataWebPChunks are the WebP chunks that stripMetadata removes, with
+// the VP8X flag announcing each of them.
+var metadataWebPChunks = map[string]byte{"EXIF": 0x08, "XMP ": 0x04}
+
+// keptGIFApplications are the GIF application extensions that stripMetadata
+// keeps, since they hold the loop count of animations. Every other
+// application extension (e.g. "XMP DataXMP") is removed.
+var keptGIFApplications = map[string]bool{"NETSCAPE2.0": true, "ANIMEXTS1.0": true}
+
+// canStripMetadata reports whether stripMetadata knows how to remove the
+// metadata of b, i.e. whether b is a JPEG, PNG, WebP or GIF.
+func canStripMetadata(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("\xFF\xD8")) ||
+		bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")) ||
+		isWebP(b) ||
+		bytes.HasPrefix(b, []byte("GIF87a")) || bytes.HasPrefix(b, []byte("GIF89a"))
+}
+
+func isWebP(b []byte) bool {
+	return len(b) >= 12 && string(b[:4]) == "RIFF" && string(b[8:12]) == "WEBP"
+}
+
+// stripMetadata returns the image b without its EXIF, XMP and other
+// metadata, which can reveal where and with what a photo was taken. A JPEG
+// that is not upright is re-encoded in its EXIF orientation first, since
+// removing the orientation tag would otherwise turn it sideways; its ICC
+// color profile is copied over to the re-encoded file. Files that
+// canStripMetadata does not accept are returned as is.
+func stripMetadata(b []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(b, []byte("\xFF\xD8")):
+		if orientation := jpegOrientation(b); orientation != 1 {
+			segments, _, err := jpegSegments(b)
+			if err != nil {
+				return nil, err
+			}
+			src, err := jpeg.Decode(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			buf := &bytes.Buffer{}
+			// jpeg.Encode writes no metadata at all, not even the ICC
+			// profile, which is inserted right after its SOI marker.
+			err = jpeg.Encode(buf, orientImage(src, orientation), &jpeg.Options{Quality: 95})
+			if err != nil {
+				return nil, err
+			}
+			encoded := buf.Bytes()
+			out := make([]byte, 0, len(encoded))
+			out = append(out, encoded[:2]...)
+			for _, segment := range segments {
+				if isICCSegment(segment) {
+					out = append(out, segment.b...)
+				}
+			}
+			return append(out, encoded[2:]...), nil
+		}
+		return stripJPEGMetadata(b)
+	case bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")):
+		return stripPNGMetadata(b)
+	case isWebP(b):
+		return stripWebPMetadata(b)
+	case bytes.HasPrefix(b, []byte("GIF87a")) || bytes.HasPrefix(b, []byte("GIF89a")):
+		return stripGIFMetadata(b)
+	}
+	return b, nil
+}
+
+// stripJPEGMetadata drops the metadataJPEGMarkers segments of the JPEG b
+// without re-encoding it. Fill bytes between the segments are dropped too.
+func stripJPEGMetadata(b []byte) ([]byte, error) {
+	segments, scan, err := jpegSegments(b)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(b))
+	out = append(out, b[:2]...)
+	for _, segment := range segments {
+		if !metadataJPEGMarkers[segment.marker] {
+			out = append(out, segment.b...)
+		}
+	}
+	// The rest of the file is image data.
+	return append(out, b[scan:]...), nil
+}
+
+// stripPNGMetadata drops the metadataPNGChunks chunks of the PNG b.
+func stripPNGMetadata(b []byte) ([]byte, error) {
+	out := make([]byte, 0, len(b))
+	out = append(out, b[:8]...)
+	for i := 8; i < len(b); {
+		if i+12 > len(b) {
+			return nil, errors.New("invalid PNG")
+		}
+		length := int(binary.BigEndian.Uint32(b[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(b) {
+			return nil, errors.New("invalid PNG")
+		}
+		if !metadataPNGChunks[string(b[i+4:i+8])] {
+			out = append(out, b[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+// stripWebPMetadata drops the metadataWebPChunks chunks of the WebP b,
+// clearing their flags in the VP8X chunk and updating the RIFF size.
+func stripWebPMetadata(b []byte) ([]byte, error) {
+	if int(binary.LittleEndian.Uint32(b[4:]))+8 > len(b) {
+		return nil, errors.New("invalid WebP")
+	}
+	out := make([]byte, 0, len(b))
+	out = append(out, b[:12]...)
+	vp8x := -1
+	var removed byte
+	for i := 12; i < len(b); {
+		if i+8 > len(b) {
+			return nil, errors.New("invalid WebP")
+		}
+		fourcc := string(b[i : i+4])
+		size := int(binary.LittleEndian.Uint32(b[i+4:]))
+		// Chunks are padded to an even size.
+		end := i + 8 + size + size%2
+		if size < 0 || i+8+size > len(b) {
+			return nil, errors.New("invalid WebP")
+		}
+		if end > len(b) {
+			end = len(b)
+		}
+		if flag, ok := metadataWebPChunks[fourcc]; ok {
+			removed |= flag
+		} else {
+			if fourcc == "VP8X" && size >= 1 {
+				vp8x = len(out) + 8
+			}
+			out = append(out, b[i:end]...)
+		}
+		i = end
+	}
+	if vp8x >= 0 {
+		out[vp8x] &^= removed
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+// stripGIFMetadata drops the comment extensions of the GIF b and the
+// application extensions that are not keptGIFApplications.
+func stripGIFMetadata(b []byte) ([]byte, error) {
+	errInvalid := errors.New("invalid GIF")
+	// skipSubBlocks returns the index after the data sub-blocks at i.
+	skipSubBlocks := func(i int) (int, error) {
+		for {
+			if i >= len(b) {
+				return 0, errInvalid
+			}
+			size := int(b[i])
+			i += 1 + size
+			if size == 0 {
+				return i, nil
+			}
+		}
+	}
+	// Header and logical screen descriptor, then the global color table.
+	if len(b) < 13 {
+		return nil, errInvalid
+	}
+	i := 13
+	if b[10]&0x80 != 0 {
+		i += 3 << (b[10]&0x07 + 1)
+	}
+	if i > len(b) {
+		return nil, errInvalid
+	}
+	out := make([]byte, 0, len(b))
+	out = append(out, b[:i]...)
+	for {
+		if i >= len(b) {
+			return nil, errInvalid
+		}
+		start := i
+		switch b[i] {
+		case 0x3B: // trailer
+			return append(out, 0x3B), nil
+		case 0x2C: // image descriptor, local color table and image data
+			if i+11 > len(b) {
+				return nil, errInvalid
+			}
+			packed := b[i+9]
+			i += 10
+			if packed&0x80 != 0 {
+				i += 3 << (packed&0x07 + 1)
+			}
+			// The byte before the image data is the LZW minimum code size.
+			end, err := skipSubBlocks(i + 1)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, b[start:end]...)
+			i = end
+		case 0x21: // extension
+			if i+2 > len(b) {
+				return nil, errInvalid
+			}
+			label := b[i+1]
+			end, err := skipSubBlocks(i + 2)
+			if err != nil {
+				return nil, err
+			}
+			keep := true
+			switch label {
+			case 0xFE: // comment
+				keep = false
+			case 0xFF: // application
+				keep = i+3+11 <= len(b) && b[i+2] == 11 && keptGIFApplications[string(b[i+3:i+14])]
+			}
+			if keep {
+				out = append(out, b[start:end]...)
+			}
+			i = end
+		default:
+			return nil, errInvalid
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package pagemanager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testImage returns a 3x2 image whose pixels are all different, so that
+// every orientation of it is distinguishable.
+func testImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 80), G: uint8(y * 80), B: 7, A: 255})
+		}
+	}
+	return img
+}
+
+func TestOrientImage(t *testing.T) {
+	src := testImage()
+	// at returns the pixel of src at (x, y), as a function of the width w
+	// and height h of src.
+	tests := []struct {
+		orientation int
+		width       int
+		height      int
+		source      func(x, y int) (int, int) // the src pixel that ends up at (x, y)
+	}{
+		{1, 3, 2, func(x, y int) (int, int) { return x, y }},
+		{2, 3, 2, func(x, y int) (int, int) { return 2 - x, y }},
+		{3, 3, 2, func(x, y int) (int, int) { return 2 - x, 1 - y }},
+		{4, 3, 2, func(x, y int) (int, int) { return x, 1 - y }},
+		{5, 2, 3, func(x, y int) (int, int) { return y, x }},
+		{6, 2, 3, func(x, y int) (int, int) { return y, 1 - x }},
+		{7, 2, 3, func(x, y int) (int, int) { return 2 - y, 1 - x }},
+		{8, 2, 3, func(x, y int) (int, int) { return 2 - y, x }},
+	}
+	for _, tt := range tests {
+		got := orientImage(src, tt.orientation)
+		if got.Bounds().Dx() != tt.width || got.Bounds().Dy() != tt.height {
+			t.Errorf("orientation %d: got %v, want %dx%d", tt.orientation, got.Bounds(), tt.width, tt.height)
+			continue
+		}
+		for y := 0; y < tt.height; y++ {
+			for x := 0; x < tt.width; x++ {
+				sx, sy := tt.source(x, y)
+				if got.At(x, y) != src.At(sx, sy) {
+					t.Errorf("orientation %d: pixel (%d, %d) is %v, want %v from (%d, %d)", tt.orientation, x, y, got.At(x, y), src.At(sx, sy), sx, sy)
+				}
+			}
+		}
+	}
+}
+
+func TestRotateImage(t *testing.T) {
+	src := testImage()
+	for _, degrees := range []int{0, 90, 180, 270, 360, -90} {
+		got := rotateImage(src, degrees)
+		// Rotating by the same angle 4 times is a full turn.
+		full := rotateImage(rotateImage(rotateImage(got, degrees), degrees), degrees)
+		if full.Bounds().Dx() != 3 || full.At(2, 1) != src.At(2, 1) || full.At(0, 0) != src.At(0, 0) {
+			t.Errorf("rotating by %d four times did not return the original", degrees)
+		}
+	}
+	if got := rotateImage(src, 90); got.At(0, 0) != src.At(0, 1) {
+		t.Errorf("rotating by 90: top left pixel is %v, want the bottom left pixel %v", got.At(0, 0), src.At(0, 1))
+	}
+}
+
+// exifSegment returns a JPEG APP1 segment holding EXIF data with the given
+// orientation, in big or little endian byte order.
+func exifSegment(orientation uint16, order binary.ByteOrder) []byte {
+	tiff := &bytes.Buffer{}
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(tiff, order, uint16(42))
+	binary.Write(tiff, order, uint32(8)) // offset of the first IFD
+	binary.Write(tiff, order, uint16(1)) // number of entries
+	binary.Write(tiff, order, uint16(0x0112))
+	binary.Write(tiff, order, uint16(3)) // SHORT
+	binary.Write(tiff, order, uint32(1))
+	binary.Write(tiff, order, orientation)
+	binary.Write(tiff, order, uint16(0))
+	binary.Write(tiff, order, uint32(0)) // no next IFD
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// jpegWithSegments returns a JPEG of testImage with segments inserted right
+// after its SOI marker.
+func jpegWithSegments(t *testing.T, segments ...[]byte) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	out := append([]byte{}, b[:2]...)
+	for _, segment := range segments {
+		out = append(out, segment...)
+	}
+	return append(out, b[2:]...)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	for orientation := uint16(1); orientation <= 8; orientation++ {
+		for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+			b := jpegWithSegments(t, exifSegment(orientation, order))
+			if got := jpegOrientation(b); got != int(orientation) {
+				t.Errorf("orientation %d (%v): got %d", orientation, order, got)
+			}
+		}
+	}
+	if got := jpegOrientation(jpegWithSegments(t)); got != 1 {
+		t.Errorf("JPEG without EXIF: got %d, want 1", got)
+	}
+	if got := jpegOrientation(jpegWithSegments(t, exifSegment(9, binary.BigEndian))); got != 1 {
+		t.Errorf("invalid orientation: got %d, want 1", got)
+	}
+	if got := jpegOrientation([]byte("not a jpeg")); got != 1 {
+		t.Errorf("not a JPEG: got %d, want 1", got)
+	}
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	comment := []byte{0xFF, 0xFE, 0, 7, 'h', 'e', 'l', 'l', 'o'}
+	xmp := append([]byte{0xFF, 0xE1, 0, 0}, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")...)
+	binary.BigEndian.PutUint16(xmp[2:], uint16(len(xmp)-2))
+	b := jpegWithSegments(t, exifSegment(1, binary.BigEndian), xmp, comment)
+	got, err := stripMetadata(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leak := range []string{"Exif", "xmpmeta", "hello"} {
+		if bytes.Contains(got, []byte(leak)) {
+			t.Errorf("%q was not stripped", leak)
+		}
+	}
+	if !bytes.Equal(got, jpegWithSegments(t)) {
+		t.Error("stripping changed more than the metadata segments")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(got)); err != nil {
+		t.Errorf("stripped JPEG does not decode: %v", err)
+	}
+	if _, err := stripJPEGMetadata(b[:30]); err == nil {
+		t.Error("truncated JPEG was not rejected")
+	}
+}
+
+func TestStripJPEGMetadataRotated(t *testing.T) {
+	b := jpegWithSegments(t, exifSegment(6, binary.BigEndian))
+	got, err := stripMetadata(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The 3x2 image is displayed rotated by 90°, so it must be stored 2x3.
+	if img.Bounds().Dx() != 2 || img.Bounds().Dy() != 3 {
+		t.Errorf("got %v, want the image stored upright as 2x3", img.Bounds())
+	}
+	if jpegOrientation(got) != 1 {
+		t.Error("stripped JPEG still has an orientation")
+	}
+}
+
+// iccSegment returns a JPEG APP2 segment holding a (fake) ICC profile.
+func iccSegment() []byte {
+	segment := append([]byte{0xFF, 0xE2, 0, 0}, []byte("ICC_PROFILE\x00\x01\x01fake profile")...)
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(segment)-2))
+	return segment
+}
+
+func TestStripJPEGMetadataRotatedKeepsICC(t *testing.T) {
+	icc := iccSegment()
+	got, err := stripMetadata(jpegWithSegments(t, icc, exifSegment(6, binary.BigEndian)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(got, icc) {
+		t.Error("the ICC profile was not kept")
+	}
+	if bytes.Contains(got, []byte("Exif")) {
+		t.Error("EXIF was not stripped")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(got)); err != nil {
+		t.Errorf("stripped JPEG does not decode: %v", err)
+	}
+}
+
+func TestStripJPEGMetadataFillBytes(t *testing.T) {
+	// Any marker may be preceded by 0xFF fill bytes.
+	exif := append([]byte{0xFF, 0xFF, 0xFF}, exifSegment(6, binary.BigEndian)...)
+	icc := append([]byte{0xFF}, iccSegment()...)
+	b := jpegWithSegments(t, icc, exif)
+	if got := jpegOrientation(b); got != 6 {
+		t.Errorf("orientation after fill bytes: got %d, want 6", got)
+	}
+	got, err := stripJPEGMetadata(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(got, []byte("Exif")) {
+		t.Error("EXIF after fill bytes was not stripped")
+	}
+	if !bytes.Equal(got, jpegWithSegments(t, iccSegment())) {
+		t.Error("stripping changed more than the metadata segments and fill bytes")
+	}
+}
+
+// pngChunk returns a PNG chunk with a valid CRC.
+func pngChunk(typ string, data []byte) []byte {
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, data...)
+	crc := crc32.ChecksumIEEE(chunk[4:])
+	return append(chunk, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	clean := buf.Bytes()
+	// Insert metadata chunks right after IHDR (8 byte signature, 25 byte IHDR).
+	var b []byte
+	b = append(b, clean[:33]...)
+	b = append(b, pngChunk("tEXt", []byte("Author\x00someone"))...)
+	b = append(b, pngChunk("eXIf", []byte("MM\x00\x2a"))...)
+	b = append(b, pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"))...)
+	b = append(b, pngChunk("tIME", []byte{0x07, 0xE5, 1, 1, 0, 0, 0})...)
+	b = append(b, clean[33:]...)
+	got, err := stripMetadata(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, clean) {
+		t.Error("metadata chunks were not stripped exactly")
+	}
+	if _, err := png.Decode(bytes.NewReader(got)); err != nil {
+		t.Errorf("stripped PNG does not decode: %v", err)
+	}
+	if _, err := stripPNGMetadata(b[:40]); err == nil {
+		t.Error("truncated PNG was not rejected")
+	}
+}
+
+func webpChunk(fourcc string, data []byte) []byte {
+	chunk := make([]byte, 8, 8+len(data)+1)
+	copy(chunk, fourcc)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func webpFile(chunks ...[]byte) []byte {
+	b := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, chunk := range chunks {
+		b = append(b, chunk...)
+	}
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)-8))
+	return b
+}
+
+func TestStripWebPMetadata(t *testing.T) {
+	// VP8X flags: ICC (0x20), EXIF (0x08) and XMP (0x04), then a 1x1 canvas.
+	vp8x := []byte{0x2C, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	data := []byte("VP8 image data")
+	b := webpFile(
+		webpChunk("VP8X", vp8x),
+		webpChunk("ICCP", []byte("icc")),
+		webpChunk("VP8 ", data),
+		webpChunk("EXIF", []byte("MM\x00\x2a exif")),
+		webpChunk("XMP ", []byte("<x:xmpmeta/>")),
+	)
+	got, err := stripMetadata(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := webpFile(
+		webpChunk("VP8X", append([]byte{0x20}, vp8x[1:]...)),
+		webpChunk("ICCP", []byte("icc")),
+		webpChunk("VP8 ", data),
+	)
+	if !bytes.Equal(got, want) {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+	if _, err := stripWebPMetadata(b[:30]); err == nil {
+		t.Error("truncated WebP was not rejected")
+	}
+}
+
+func TestStripGIFMetadata(t *testing.T) {
+	// A 1x1 GIF89a with a 2 color global color table.
+	header := []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\xff\xff\xff")
+	netscape := []byte("\x21\xFF\x0BNETSCAPE2.0\x03\x01\x00\x00\x00")
+	control := []byte("\x21\xF9\x04\x00\x00\x00\x00\x00")
+	img := []byte("\x2C\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02\x44\x01\x00")
+	comment := []byte("\x21\xFE\x07secrets\x00")
+	xmp := []byte("\x21\xFF\x0BXMP DataXMP\x05<x:x>\x00")
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	b := join(header, netscape, comment, control, img, xmp, []byte{0x3B})
+	got, err := stripMetadata(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := join(header, netscape, control, img, []byte{0x3B}); !bytes.Equal(got, want) {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+	if _, err := stripGIFMetadata(b[:len(b)-3]); err == nil {
+		t.Error("truncated GIF was not rejected")
+	}
+	buf := &bytes.Buffer{}
+	if err := gif.Encode(buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	b = join(encoded[:len(encoded)-1], comment, xmp, []byte{0x3B})
+	got, err = stripMetadata(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, encoded) {
+		t.Error("metadata extensions were not stripped exactly from an encoded GIF")
+	}
+	if _, err := gif.Decode(bytes.NewReader(got)); err != nil {
+		t.Errorf("stripped GIF does not decode: %v", err)
+	}
+}
@@ -0,0 +1,283 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+)
+
+var gcGracePeriod = flag.Duration("pm-gc-grace-period", 7*24*time.Hour, "how long an unreferenced upload is kept before garbage collection deletes it")
+
+// GCOptions configures CollectGarbage.
+type GCOptions struct {
+	// GracePeriod is how old an unreferenced upload must be before it is
+	// deleted. It protects files that were just uploaded but not yet saved
+	// into any content.
+	GracePeriod time.Duration
+
+	// DryRun only reports what would be deleted.
+	DryRun bool
+}
+
+// Orphan is an upload that nothing references.
+type Orphan struct {
+	Path      string    `json:"path"` // relative to the datafolder
+	MediaID   string    `json:"media_id,omitempty"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	Expired   bool      `json:"expired"` // older than the grace period
+	Deleted   bool      `json:"deleted"`
+	NoFile    bool      `json:"no_file,omitempty"`   // only the pm_media row exists
+	Untracked bool      `json:"untracked,omitempty"` // the file has no pm_media row
+}
+
+// GCReport is the result of CollectGarbage.
+type GCReport struct {
+	Uploads       int      `json:"uploads"`
+	Referenced    int      `json:"referenced"`
+	Orphans       []Orphan `json:"orphans"`
+	StaleVariants []string `json:"stale_variants"` // relative to the datafolder
+}
+
+// uploadRefPattern matches references to uploaded files, with or without
+// the /static/ prefix. Query strings (e.g. image variants' ?w=) are not part
+// of the match.
+var uploadRefPattern = regexp.MustCompile(uploadsDir + `/[^\s"'()<>\\?#{}]+`)
+
+var mediaIDPattern = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+
+// themeTextExts are the theme files that are scanned for upload references.
+var themeTextExts = map[string]bool{
+	".html": true, ".css": true, ".js": true, ".toml": true, ".json": true, ".md": true, ".txt": true,
+}
+
+// uploadRefs collects the upload paths and media IDs referenced by the
+// published data, drafts and revisions in pm_templatedata, the content of
+// pm_routes, collection items and theme files. Uploads that are only
+// referenced through a path built at render time (e.g. by concatenating
+// strings in a template) cannot be found and must be kept some other way.
+func (pm *PageManager) uploadRefs(ctx context.Context) (paths, mediaIDs map[string]bool, err error) {
+	paths, mediaIDs = make(map[string]bool), make(map[string]bool)
+	scan := func(s string) {
+		// JSON may escape slashes.
+		s = strings.ReplaceAll(s, `\/`, "/")
+		for _, ref := range uploadRefPattern.FindAllString(s, -1) {
+			paths[path.Clean(strings.TrimRight(ref, ".,;:"))] = true
+		}
+		for _, id := range mediaIDPattern.FindAllString(s, -1) {
+			mediaIDs[id] = true
+		}
+	}
+	queries := []string{
+		"SELECT COALESCE(data, '') || ' ' || COALESCE(draft, '') FROM pm_templatedata",
+		"SELECT COALESCE(data, '') FROM pm_templatedata_revisions",
+		"SELECT COALESCE(content, '') FROM pm_routes",
+		"SELECT COALESCE(fields, '') FROM pm_collection_items",
+	}
+	for _, query := range queries {
+		rows, err := pm.db.QueryContext(ctx, query)
+		if err != nil {
+			return paths, mediaIDs, erro.Wrap(err)
+		}
+		for rows.Next() {
+			var s string
+			err = rows.Scan(&s)
+			if err != nil {
+				rows.Close()
+				return paths, mediaIDs, erro.Wrap(err)
+			}
+			scan(s)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return paths, mediaIDs, erro.Wrap(err)
+		}
+	}
+	err = fs.WalkDir(pm.fsys, "templates", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !themeTextExts[strings.ToLower(path.Ext(name))] {
+			return nil
+		}
+		b, err := fs.ReadFile(pm.fsys, name)
+		if err != nil {
+			return err
+		}
+		scan(string(b))
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return paths, mediaIDs, erro.Wrap(err)
+	}
+	return paths, mediaIDs, nil
+}
+
+// CollectGarbage finds the files in the uploads folder and the media library
+// that nothing references, and deletes the ones older than the grace period
+// (unless opts.DryRun is set). Deletions are recorded in the audit log.
+// Cached image variants whose original no longer exists are deleted too.
+func (pm *PageManager) CollectGarbage(ctx context.Context, opts GCOptions) (GCReport, error) {
+	var report GCReport
+	refs, mediaIDs, err := pm.uploadRefs(ctx)
+	if err != nil {
+		return report, erro.Wrap(err)
+	}
+	uploads := make(map[string]*Orphan)
+	err = fs.WalkDir(pm.fsys, uploadsDir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		uploads[name] = &Orphan{Path: name, Size: info.Size(), ModTime: info.ModTime(), Untracked: true}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return report, erro.Wrap(err)
+	}
+	media, err := pm.ListMedia(ctx)
+	if err != nil {
+		return report, erro.Wrap(err)
+	}
+	// Originals are kept for as long as an image cropped from them exists.
+	originals := make(map[string]bool)
+	for _, m := range media {
+		if m.OriginalID != "" {
+			originals[m.OriginalID] = true
+		}
+		o, ok := uploads[m.Path]
+		if !ok {
+			o = &Orphan{Path: m.Path, Size: m.Size, ModTime: m.UploadedAt, NoFile: true}
+			uploads[m.Path] = o
+		}
+		o.MediaID = m.ID
+		o.Untracked = false
+		if m.UploadedAt.After(o.ModTime) {
+			o.ModTime = m.UploadedAt
+		}
+	}
+	report.Uploads = len(uploads)
+	names := make([]string, 0, len(uploads))
+	for name := range uploads {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cutoff := time.Now().Add(-opts.GracePeriod)
+	for _, name := range names {
+		o := uploads[name]
+		if refs[name] || (o.MediaID != "" && (mediaIDs[o.MediaID] || originals[o.MediaID])) {
+			report.Referenced++
+			continue
+		}
+		o.Expired = o.ModTime.Before(cutoff)
+		if o.Expired && !opts.DryRun {
+			err = pm.deleteOrphan(ctx, *o)
+			if err != nil {
+				return report, erro.Wrap(err)
+			}
+			o.Deleted = true
+		}
+		report.Orphans = append(report.Orphans, *o)
+	}
+	report.StaleVariants, err = pm.staleVariants(opts.DryRun)
+	if err != nil {
+		return report, erro.Wrap(err)
+	}
+	return report, nil
+}
+
+func (pm *PageManager) deleteOrphan(ctx context.Context, o Orphan) error {
+	if o.MediaID != "" {
+		_, err := pm.DeleteMedia(ctx, o.MediaID)
+		return err
+	}
+	b, exists, err := readStorage(ctx, pm.storage, o.Path)
+	if err != nil || !exists {
+		return err
+	}
+	return pm.withTx(ctx, func(tx *sql.Tx) error {
+		err := audit(ctx, tx, AuditDelete, "file:"+o.Path, contentHash(b, true), "")
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return pm.storage.Delete(ctx, o.Path)
+	})
+}
+
+// staleVariants returns (and unless dryRun is set, deletes) the cached image
+// variants that were not made from any current image in the uploads or
+// templates folders. Variants of images in other filesystems are removed as
+// well; they are simply regenerated the next time they are requested.
+func (pm *PageManager) staleVariants(dryRun bool) ([]string, error) {
+	var stale []string
+	versions := make(map[string]bool)
+	for _, dir := range []string{uploadsDir, "templates"} {
+		err := fs.WalkDir(pm.fsys, dir, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !isResizable(name) {
+				return nil
+			}
+			// Stat rather than d.Info, so that the version is computed from
+			// the same FileInfo that imageVariant gets.
+			info, err := fs.Stat(pm.fsys, name)
+			if err != nil {
+				return err
+			}
+			version, _, err := variantVersion(pm.fsys, name, info)
+			if err != nil {
+				return err
+			}
+			versions[version] = true
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return stale, erro.Wrap(err)
+		}
+	}
+	err := fs.WalkDir(pm.fsys, variantsDir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		// Variants are named {version}-w{width}-q{quality}.{ext}.
+		base := path.Base(name)
+		if i := strings.Index(base, "-w"); i > 0 && versions[base[:i]] {
+			return nil
+		}
+		stale = append(stale, name)
+		if dryRun {
+			return nil
+		}
+		err = os.Remove(filepath.Join(pm.datafolder, filepath.FromSlash(name)))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return stale, erro.Wrap(err)
+	}
+	return stale, nil
+}
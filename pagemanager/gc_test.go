@@ -0,0 +1,67 @@
+package pagemanager
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestCollectGarbageKeepsVariants checks that garbage collection keeps the
+// cached variants of current images, and only deletes them once their
+// original changes.
+func TestCollectGarbageKeepsVariants(t *testing.T) {
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	const name = uploadsDir + "/photo.png"
+	writeImage := func(width int) {
+		buf := &bytes.Buffer{}
+		err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, width, 10)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pm.writeFile(ctx, name, buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeImage(100)
+	variant, err := pm.imageVariant(ctx, name, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variant == "" {
+		t.Fatal("no variant was made")
+	}
+	report, err := pm.CollectGarbage(ctx, GCOptions{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.StaleVariants) != 0 {
+		t.Errorf("variants of a current image are reported stale: %v", report.StaleVariants)
+	}
+	if _, err := os.Stat(variant); err != nil {
+		t.Fatalf("the variant of a current image was deleted: %v", err)
+	}
+
+	// Give the changed original a different modification time even on
+	// filesystems with coarse timestamps.
+	writeImage(120)
+	err = os.Chtimes(pm.datafolder+"/"+name, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = pm.CollectGarbage(ctx, GCOptions{GracePeriod: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.StaleVariants) != 1 {
+		t.Errorf("got stale variants %v, want the variant of the changed image", report.StaleVariants)
+	}
+	if _, err := os.Stat(variant); !os.IsNotExist(err) {
+		t.Errorf("the variant of a changed image was not deleted: %v", err)
+	}
+}
@@ -0,0 +1,310 @@
+package pagemanager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"html/template"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	imageWidths  = flag.String("pm-image-widths", "320,640,960,1280,1920", "comma separated widths that image variants may be resized to")
+	imageQuality = flag.Int("pm-image-quality", 85, "JPEG quality of image variants")
+)
+
+// variantsDir is the folder in the datafolder that resized image variants
+// are cached in. It is not served directly: variants are requested by adding
+// ?w={width} to the /static/ URL of the original image. Variants are always
+// cached on local disk, whichever -pm-storage the originals are stored in.
+const variantsDir = "pm-cache/variants"
+
+// variantWidths returns the widths allowed by -pm-image-widths, smallest
+// first. Only these widths are generated so that arbitrary ?w= values cannot
+// fill up the variants cache.
+func variantWidths() []int {
+	var widths []int
+	for _, s := range strings.Split(*imageWidths, ",") {
+		if w, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && w > 0 {
+			widths = append(widths, w)
+		}
+	}
+	sort.Ints(widths)
+	return widths
+}
+
+func isVariantWidth(w int) bool {
+	for _, width := range variantWidths() {
+		if width == w {
+			return true
+		}
+	}
+	return false
+}
+
+// isResizable reports whether name is an image that variants can be made of.
+func isResizable(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
+}
+
+// imageVariantMiddleware serves resized variants of the JPEG and PNG files
+// under /static/ that are requested with a ?w={width} query parameter. The
+// original is served when the requested width is not one of -pm-image-widths
+// or is not smaller than the original.
+func (pm *PageManager) imageVariantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/static/")
+		width, err := strconv.Atoi(r.URL.Query().Get("w"))
+		if name == r.URL.Path || err != nil || !isVariantWidth(width) || !isResizable(name) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		variant, err := pm.imageVariant(r.Context(), name, width)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("image variant: %v\n", err)
+			http.Error(w, "could not resize the image", http.StatusInternalServerError)
+			return
+		}
+		if variant == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.ServeFile(w, r, variant)
+	})
+}
+
+// variantDecodes bounds how many originals imageVariant decodes at once, as
+// each one is held in memory at full size while it is resized.
+var variantDecodes = make(chan struct{}, runtime.NumCPU())
+
+// variantVersion returns the version of the file name in fsys (described by
+// info) that the names of its cached variants start with. It is the hash of
+// the name, size and modification time of the file, so that serving a cached
+// variant does not read the original and a changed original never gets a
+// stale variant. Files without a modification time (e.g. embedded themes)
+// are versioned by the hash of their content instead, which is returned as
+// well so that it does not have to be read again.
+func variantVersion(fsys fs.FS, name string, info fs.FileInfo) (version string, b []byte, err error) {
+	if !info.ModTime().IsZero() {
+		return contentHash([]byte(fmt.Sprintf("%s\x00%d\x00%d", name, info.Size(), info.ModTime().UnixNano())), true), nil, nil
+	}
+	b, err = fs.ReadFile(fsys, name)
+	if err != nil {
+		return "", nil, err
+	}
+	return contentHash(b, true), b, nil
+}
+
+// imageVariant returns the path of the cached variant of the static file
+// name resized to width, generating it if it does not exist yet. It returns
+// an empty path if the original is not wider than width. Variants are named
+// {version}-w{width}-q{quality}.{ext}, see variantVersion.
+func (pm *PageManager) imageVariant(ctx context.Context, name string, width int) (string, error) {
+	fsys := pm.renderly.Fsys()
+	info, err := fs.Stat(fsys, name)
+	if err != nil {
+		return "", err
+	}
+	version, b, err := variantVersion(fsys, name, info)
+	if err != nil {
+		return "", err
+	}
+	ext := strings.ToLower(path.Ext(name))
+	if ext == ".jpeg" {
+		ext = ".jpg"
+	}
+	key := fmt.Sprintf("%s-w%d-q%d%s", version, width, *imageQuality, ext)
+	dst := filepath.Join(pm.datafolder, filepath.FromSlash(variantsDir), key[:2], key)
+	if _, err := os.Stat(dst); err == nil {
+		return dst, nil
+	}
+	if b == nil {
+		b, err = fs.ReadFile(fsys, name)
+		if err != nil {
+			return "", err
+		}
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	// Orientations 5 to 8 swap the width and the height.
+	orientation := jpegOrientation(b)
+	displayWidth := config.Width
+	if orientation >= 5 {
+		displayWidth = config.Height
+	}
+	if displayWidth <= width {
+		return "", nil
+	}
+	select {
+	case variantDecodes <- struct{}{}:
+		defer func() { <-variantDecodes }()
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	// Another request may have made the variant while this one waited.
+	if _, err := os.Stat(dst); err == nil {
+		return dst, nil
+	}
+	src, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	// The variant is encoded without the EXIF data of the original, so it
+	// must be put in its display orientation first.
+	src = orientImage(src, orientation)
+	resized := resizeImage(src, width)
+	buf := &bytes.Buffer{}
+	if ext == ".png" {
+		err = png.Encode(buf, resized)
+	} else {
+		err = jpeg.Encode(buf, resized, &jpeg.Options{Quality: *imageQuality})
+	}
+	if err != nil {
+		return "", err
+	}
+	// LocalStorage writes to a temporary file first so that concurrent
+	// requests never serve a half written variant.
+	err = NewLocalStorage(pm.datafolder).Put(context.Background(), variantsDir+"/"+key[:2]+"/"+key, buf)
+	if err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// resizeImage scales src down to width (keeping its aspect ratio) by
+// averaging the source pixels that each destination pixel covers.
+func resizeImage(src image.Image, width int) *image.RGBA {
+	sb := src.Bounds()
+	height := sb.Dy() * width / sb.Dx()
+	if height < 1 {
+		height = 1
+	}
+	return scaleImage(src, width, height)
+}
+
+// scaleImage scales src to width x height. Each destination pixel is the
+// average of the source pixels it covers, or the nearest source pixel when
+// scaling up.
+func scaleImage(src image.Image, width, height int) *image.RGBA {
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	rgba, ok := src.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(image.Rect(0, 0, sw, sh))
+		draw.Draw(rgba, rgba.Bounds(), src, sb.Min, draw.Src)
+	} else if sb.Min != (image.Point{}) {
+		rgba = rgba.SubImage(sb).(*image.RGBA)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for dy := 0; dy < height; dy++ {
+		y0, y1 := dy*sh/height, (dy+1)*sh/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for dx := 0; dx < width; dx++ {
+			x0, x1 := dx*sw/width, (dx+1)*sw/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint32
+			for y := y0; y < y1; y++ {
+				i := rgba.PixOffset(rgba.Rect.Min.X+x0, rgba.Rect.Min.Y+y)
+				for x := x0; x < x1; x++ {
+					r += uint32(rgba.Pix[i])
+					g += uint32(rgba.Pix[i+1])
+					b += uint32(rgba.Pix[i+2])
+					a += uint32(rgba.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+			j := dst.PixOffset(dx, dy)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// srcset returns the src, srcset and sizes attributes of an <img> showing
+// the static image at src, offering every -pm-image-widths variant smaller
+// than the original. sizes defaults to 100vw. If the image is missing or
+// cannot be decoded, srcset logs it and returns only the src attribute. e.g.
+//
+//	<img {{ srcset .Env "/static/templates/plainsimple/hero.jpg" "(min-width: 60em) 50vw, 100vw" }} alt="">
+func (pm *PageManager) srcset(env map[string]interface{}, src string, sizes ...string) (template.HTMLAttr, error) {
+	prefix, _ := env["StaticPrefix"].(string)
+	if prefix == "" {
+		prefix = "/static"
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(src, prefix), "/")
+	url := prefix + "/" + name
+	attrs := `src="` + html.EscapeString(url) + `"`
+	if !isResizable(name) {
+		return template.HTMLAttr(attrs), nil
+	}
+	f, err := pm.renderly.Fsys().Open(name)
+	if err != nil {
+		log.Printf("srcset: %v\n", err)
+		return template.HTMLAttr(attrs), nil
+	}
+	// The EXIF orientation is read from the start of the file, where JPEGs
+	// keep it, to get the width the image is displayed at.
+	head, err := io.ReadAll(io.LimitReader(f, 1<<17))
+	if err != nil {
+		f.Close()
+		log.Printf("srcset: %s: %v\n", name, err)
+		return template.HTMLAttr(attrs), nil
+	}
+	config, _, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(head), f))
+	f.Close()
+	if err != nil {
+		log.Printf("srcset: %s: %v\n", name, err)
+		return template.HTMLAttr(attrs), nil
+	}
+	if jpegOrientation(head) >= 5 {
+		config.Width = config.Height
+	}
+	var candidates []string
+	for _, width := range variantWidths() {
+		if width < config.Width {
+			candidates = append(candidates, url+"?w="+strconv.Itoa(width)+" "+strconv.Itoa(width)+"w")
+		}
+	}
+	candidates = append(candidates, url+" "+strconv.Itoa(config.Width)+"w")
+	size := "100vw"
+	if len(sizes) > 0 && sizes[0] != "" {
+		size = sizes[0]
+	}
+	attrs += ` srcset="` + html.EscapeString(strings.Join(candidates, ", ")) + `" sizes="` + html.EscapeString(size) + `"`
+	return template.HTMLAttr(attrs), nil
+}
@@ -0,0 +1,26 @@
+package pagemanager
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImageVariantMiddlewareDecodeError(t *testing.T) {
+	pm := newTestPageManager(t)
+	err := pm.writeFile(context.Background(), uploadsDir+"/broken.png", []byte("not a png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := pm.imageVariantMiddleware(http.NotFoundHandler())
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/static/"+uploadsDir+"/broken.png?w=320", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "broken.png") || strings.Contains(body, "format") {
+		t.Errorf("the decode error is sent to the client: %s", body)
+	}
+}
@@ -0,0 +1,435 @@
+package pagemanager
+
+import (
+	"bytes"
+	"context"
+	"html"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+)
+
+// maxLinkRedirects is how many redirects CheckLinks follows before giving up
+// on a link.
+const maxLinkRedirects = 10
+
+// linkReportMaxAge is how long serveLinks serves the same report before
+// checking the links again, unless it is asked to with ?refresh=true.
+const linkReportMaxAge = time.Minute
+
+// BrokenLink is an internal link whose target cannot be reached, or can only
+// be reached through several redirects.
+type BrokenLink struct {
+	Source  string   `json:"source"` // URL of the page the link is on
+	URL     string   `json:"url"`    // the link, resolved against Source
+	Problem string   `json:"problem"`
+	Status  int      `json:"status,omitempty"` // for not_found links served by a handler
+	Chain   []string `json:"chain,omitempty"`  // the redirects followed, starting with URL
+}
+
+// Link problems reported by CheckLinks.
+const (
+	LinkNotFound      = "not_found"      // nothing is served at the target
+	LinkDisabled      = "disabled"       // the target route is disabled
+	LinkRedirectChain = "redirect_chain" // the target redirects more than once
+	LinkRedirectLoop  = "redirect_loop"  // the target's redirects never end
+)
+
+// LinkReport is the result of CheckLinks.
+type LinkReport struct {
+	CheckedAt time.Time    `json:"checked_at"` // when the links were checked
+	Pages     int          `json:"pages"`      // pages whose links were checked
+	Links     int          `json:"links"`      // distinct internal links found on them
+	Broken    []BrokenLink `json:"broken"`     // ordered by source, then URL
+	Errors    []string     `json:"errors"`     // pages that could not be rendered
+}
+
+// linkPattern matches the href of <a> and <area> elements.
+var linkPattern = regexp.MustCompile(`(?is)<(?:a|area)\b[^>]*?\shref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+
+// pageLinks returns the internal links in the HTML b of the page at source,
+// resolved against source. Links to other sites, fragments of the same page
+// and non-HTTP links (mailto:, tel:...) are left out.
+func pageLinks(source string, b []byte) []string {
+	base, err := url.Parse(source)
+	if err != nil {
+		return nil
+	}
+	var links []string
+	for _, match := range linkPattern.FindAllSubmatch(b, -1) {
+		href := string(match[1]) + string(match[2]) + string(match[3])
+		if link, ok := internalLink(base, html.UnescapeString(href)); ok {
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// internalLink resolves href against base, reporting whether it is a link to
+// another page of this site. The query and fragment are dropped.
+func internalLink(base *url.URL, href string) (string, bool) {
+	href = strings.TrimSpace(href)
+	if href == "" || strings.HasPrefix(href, "#") {
+		return "", false
+	}
+	u, err := url.Parse(href)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return "", false
+	}
+	u = base.ResolveReference(u)
+	if u.Path == "" {
+		return "", false
+	}
+	return u.Path, true
+}
+
+// linkStatusRecorder is the http.ResponseWriter that pages and mounted
+// handlers are served to while checking links.
+type linkStatusRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *linkStatusRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *linkStatusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *linkStatusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+// linkChecker resolves links for CheckLinks, remembering the result of
+// every target.
+type linkChecker struct {
+	pm      *PageManager
+	ctx     context.Context
+	handler http.Handler // the handler wrapped by Middleware, may be nil
+	mux     *http.ServeMux
+	page    http.Handler
+	results map[string]BrokenLink // by target; Problem is empty if the link works
+}
+
+// serve serves a request for p to h, returning what was written.
+func (c *linkChecker) serve(h http.Handler, method, p string) (*linkStatusRecorder, error) {
+	r, err := http.NewRequestWithContext(c.ctx, method, p, nil)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	rec := &linkStatusRecorder{header: make(http.Header)}
+	h.ServeHTTP(rec, r)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec, nil
+}
+
+// check resolves the link target p the way Middleware would serve it,
+// following redirects.
+func (c *linkChecker) check(p string) (BrokenLink, error) {
+	if result, ok := c.results[p]; ok {
+		return result, nil
+	}
+	result := BrokenLink{URL: p}
+	chain := []string{p}
+	seen := map[string]bool{p: true}
+	for target := p; ; {
+		next, problem, status, err := c.resolve(target)
+		if err != nil {
+			return result, erro.Wrap(err)
+		}
+		if problem != "" {
+			result.Problem, result.Status = problem, status
+			break
+		}
+		if next == "" {
+			break
+		}
+		chain = append(chain, next)
+		if seen[next] || len(chain) > maxLinkRedirects {
+			result.Problem = LinkRedirectLoop
+			break
+		}
+		seen[next] = true
+		target = next
+	}
+	// A single redirect (e.g. from a renamed route) is fine, a link that has
+	// to go through several of them should point at the final page instead.
+	if result.Problem == "" && len(chain) > 2 {
+		result.Problem = LinkRedirectChain
+	}
+	if result.Problem != "" && len(chain) > 1 {
+		result.Chain = chain
+	}
+	c.results[p] = result
+	return result, nil
+}
+
+// resolve looks up the single link target p. If p redirects to another page
+// of this site, next is its path.
+func (c *linkChecker) resolve(p string) (next, problem string, status int, err error) {
+	pm := c.pm
+	route, err := pm.getroute(p)
+	if err != nil {
+		return "", "", 0, erro.Wrap(err)
+	}
+	if route.URL.Valid {
+		switch {
+		case route.Disabled.Valid && route.Disabled.Bool:
+			return "", LinkDisabled, 0, nil
+		case route.RedirectURL.Valid:
+			base, _ := url.Parse(p)
+			next, ok := internalLink(base, route.RedirectURL.String)
+			if !ok {
+				return "", "", 0, nil // redirects to another site
+			}
+			return next, "", 0, nil
+		case route.HandlerURL.Valid:
+			return c.resolveHandler(route.HandlerURL.String)
+		default:
+			return "", "", 0, nil
+		}
+	}
+	// Static files
+	if strings.HasPrefix(p, "/static/") {
+		// Cleaned as an absolute path so that it cannot climb out of the
+		// datafolder; /static/ itself is the datafolder.
+		name := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(p, "/static/")), "/")
+		if name == "" {
+			name = "."
+		}
+		if _, err := fs.Stat(pm.fsys, name); err != nil {
+			return "", LinkNotFound, 0, nil
+		}
+		return "", "", 0, nil
+	}
+	// Collection pages
+	collection, slug, ok, err := pm.matchCollection(p)
+	if err != nil {
+		return "", "", 0, erro.Wrap(err)
+	}
+	if ok && slug == "" && collection.IndexTemplate != "" {
+		return "", "", 0, nil
+	}
+	if ok && slug != "" && collection.ItemTemplate != "" {
+		_, exists, err := pm.GetItem(collection.Name, slug)
+		if err != nil {
+			return "", "", 0, erro.Wrap(err)
+		}
+		if !exists {
+			return "", LinkNotFound, 0, nil
+		}
+		return "", "", 0, nil
+	}
+	return c.resolveHandler(p)
+}
+
+// resolveHandler looks up p among the PageManager endpoints and, failing
+// that, sends a HEAD request for it to the mounted handler, so that the
+// handler does not do the work of serving the page.
+func (c *linkChecker) resolveHandler(p string) (next, problem string, status int, err error) {
+	r, err := http.NewRequestWithContext(c.ctx, http.MethodGet, p, nil)
+	if err != nil {
+		return "", "", 0, erro.Wrap(err)
+	}
+	if _, pattern := c.mux.Handler(r); pattern != "/" {
+		return "", "", 0, nil
+	}
+	if c.handler == nil {
+		return "", LinkNotFound, 0, nil
+	}
+	rec, err := c.serve(c.handler, http.MethodHead, p)
+	if err != nil {
+		return "", "", 0, erro.Wrap(err)
+	}
+	// Fall back to GET for handlers that do not support HEAD.
+	if rec.status == http.StatusMethodNotAllowed || rec.status == http.StatusNotImplemented {
+		rec, err = c.serve(c.handler, http.MethodGet, p)
+		if err != nil {
+			return "", "", 0, erro.Wrap(err)
+		}
+	}
+	switch {
+	case rec.status >= 300 && rec.status < 400:
+		base, _ := url.Parse(p)
+		if next, ok := internalLink(base, rec.header.Get("Location")); ok {
+			return next, "", 0, nil
+		}
+		return "", "", 0, nil
+	case rec.status >= 400:
+		return "", LinkNotFound, rec.status, nil
+	}
+	return "", "", 0, nil
+}
+
+// CheckLinks renders every enabled page (routes with a template, collection
+// index and item pages) and reads the content of every content route, then
+// checks that each internal link on them leads somewhere: to an enabled
+// route, a static file, a collection page, a PageManager endpoint or a page
+// served by handler (the handler wrapped by Middleware, nil if there is
+// none). Links that only reach their target through several redirects are
+// reported too, as are routes that redirect to a missing page.
+func (pm *PageManager) CheckLinks(ctx context.Context, handler http.Handler) (LinkReport, error) {
+	report := LinkReport{CheckedAt: time.Now().UTC()}
+	c := &linkChecker{
+		pm:      pm,
+		ctx:     ctx,
+		handler: handler,
+		results: make(map[string]BrokenLink),
+	}
+	if handler == nil {
+		handler = http.NotFoundHandler()
+	}
+	c.mux = pm.newmux(handler)
+	c.page = pm.middleware(handler)
+	// Links found on each page, by the URL of the page.
+	sources := make(map[string][]string)
+	var pages []string
+	rows, err := pm.db.QueryContext(ctx, "SELECT url, disabled, redirect_url, handler_url, content, template FROM pm_routes ORDER BY url")
+	if err != nil {
+		return report, erro.Wrap(err)
+	}
+	var routes []Route
+	for rows.Next() {
+		var route Route
+		err = rows.Scan(&route.URL, &route.Disabled, &route.RedirectURL, &route.HandlerURL, &route.Content, &route.Template)
+		if err != nil {
+			rows.Close()
+			return report, erro.Wrap(err)
+		}
+		routes = append(routes, route)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return report, erro.Wrap(err)
+	}
+	for _, route := range pm.routemap {
+		routes = append(routes, route)
+	}
+	for _, route := range routes {
+		source := route.URL.String
+		switch {
+		case route.Disabled.Valid && route.Disabled.Bool:
+			continue
+		case route.RedirectURL.Valid:
+			base, _ := url.Parse(source)
+			if link, ok := internalLink(base, route.RedirectURL.String); ok {
+				sources[source] = append(sources[source], link)
+			}
+		case route.HandlerURL.Valid:
+			continue
+		case route.Content.Valid:
+			sources[source] = append(sources[source], pageLinks(source, []byte(route.Content.String))...)
+		case route.Template.Valid:
+			pages = append(pages, source)
+		}
+	}
+	collections, err := pm.ListCollections()
+	if err != nil {
+		return report, erro.Wrap(err)
+	}
+	for _, collection := range collections {
+		if collection.IndexTemplate != "" {
+			pages = append(pages, collection.URLPrefix)
+		}
+		if collection.ItemTemplate == "" {
+			continue
+		}
+		items, err := pm.ListItems(collection.Name)
+		if err != nil {
+			return report, erro.Wrap(err)
+		}
+		for _, item := range items {
+			pages = append(pages, collection.URL(item.Slug))
+		}
+	}
+	for _, page := range pages {
+		rec, err := c.serve(c.page, http.MethodGet, page)
+		if err != nil {
+			return report, erro.Wrap(err)
+		}
+		if rec.status >= 400 {
+			report.Errors = append(report.Errors, page+": "+http.StatusText(rec.status))
+			continue
+		}
+		sources[page] = append(sources[page], pageLinks(page, rec.body.Bytes())...)
+	}
+	report.Pages = len(sources)
+	names := make([]string, 0, len(sources))
+	for source := range sources {
+		names = append(names, source)
+	}
+	sort.Strings(names)
+	for _, source := range names {
+		links := sources[source]
+		sort.Strings(links)
+		for i, link := range links {
+			if i > 0 && link == links[i-1] {
+				continue
+			}
+			result, err := c.check(link)
+			if err != nil {
+				return report, erro.Wrap(err)
+			}
+			if result.Problem != "" {
+				result.Source = source
+				report.Broken = append(report.Broken, result)
+			}
+		}
+	}
+	report.Links = len(c.results)
+	sort.Strings(report.Errors)
+	return report, nil
+}
+
+// serveLinks serves the broken link report of CheckLinks as JSON. handler is
+// the handler wrapped by Middleware. The report is cached for
+// linkReportMaxAge (?refresh=true checks the links again), and requests that
+// arrive while the links are being checked wait for that report instead of
+// starting another check.
+func (pm *PageManager) serveLinks(w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	requested := time.Now()
+	pm.linksMu.Lock()
+	defer pm.linksMu.Unlock()
+	cached := pm.linkReport
+	// A report that was checked after this request arrived is fresh enough
+	// even when a refresh is asked for.
+	if cached == nil || time.Since(cached.CheckedAt) > linkReportMaxAge || (r.URL.Query().Get("refresh") == "true" && cached.CheckedAt.Before(requested)) {
+		report, err := pm.CheckLinks(r.Context(), handler)
+		if err != nil {
+			http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+			return
+		}
+		pm.linkReport = &report
+	}
+	report := *pm.linkReport
+	if report.Broken == nil {
+		report.Broken = []BrokenLink{}
+	}
+	if report.Errors == nil {
+		report.Errors = []string{}
+	}
+	writeJSON(w, http.StatusOK, report)
+}
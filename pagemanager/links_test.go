@@ -0,0 +1,48 @@
+package pagemanager
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestInternalLink(t *testing.T) {
+	base, _ := url.Parse("/blog/post")
+	tests := []struct {
+		href string
+		want string // empty if href is not an internal link
+	}{
+		{"/about", "/about"},
+		{"/about?x=1#team", "/about"},
+		{"other-post", "/blog/other-post"},
+		{"../contact/", "/contact/"},
+		{"./", "/blog/"},
+		{"  /padded  ", "/padded"},
+		{"#top", ""},
+		{"", ""},
+		{"https://example.com/about", ""},
+		{"//example.com/about", ""},
+		{"mailto:someone@example.com", ""},
+		{"tel:+123", ""},
+		{"javascript:alert(1)", ""},
+		{"?page=2", "/blog/post"},
+	}
+	for _, tt := range tests {
+		got, ok := internalLink(base, tt.href)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("internalLink(%q) = %q, %v, want %q", tt.href, got, ok, tt.want)
+		}
+	}
+}
+
+func TestPageLinks(t *testing.T) {
+	html := `<p><a href="/about">About</a> <A class="x" HREF='/contact'>Contact</A>
+		<a href=/unquoted>u</a> <a data-href="/not-a-link">x</a> <link href="/style.css">
+		<area shape="rect" href="/map"> <a href="https://example.com/">ext</a>
+		<a href="/search?q=a&amp;b=c">s</a> <a name="anchor">no href</a></p>`
+	got := pageLinks("/", []byte(html))
+	want := []string{"/about", "/contact", "/unquoted", "/map", "/search"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pageLinks = %q, want %q", got, want)
+	}
+}
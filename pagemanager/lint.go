@@ -0,0 +1,207 @@
+package pagemanager
+
+import (
+	"fmt"
+	"html/template"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bokwoon95/erro"
+)
+
+// cspDirectives is the set of Content-Security-Policy directive names that
+// may appear under content_security_policy in a templates-config.
+var cspDirectives = map[string]struct{}{
+	"base-uri":                  {},
+	"block-all-mixed-content":   {},
+	"child-src":                 {},
+	"connect-src":               {},
+	"default-src":               {},
+	"font-src":                  {},
+	"form-action":               {},
+	"frame-ancestors":           {},
+	"frame-src":                 {},
+	"img-src":                   {},
+	"manifest-src":              {},
+	"media-src":                 {},
+	"navigate-to":               {},
+	"object-src":                {},
+	"plugin-types":              {},
+	"prefetch-src":              {},
+	"report-to":                 {},
+	"report-uri":                {},
+	"require-sri-for":           {},
+	"require-trusted-types-for": {},
+	"sandbox":                   {},
+	"script-src":                {},
+	"script-src-attr":           {},
+	"script-src-elem":           {},
+	"style-src":                 {},
+	"style-src-attr":            {},
+	"style-src-elem":            {},
+	"trusted-types":             {},
+	"upgrade-insecure-requests": {},
+	"worker-src":                {},
+}
+
+// LintIssue is a single problem found by Lint.
+type LintIssue struct {
+	File    string
+	Message string
+}
+
+func (issue LintIssue) String() string {
+	return issue.File + ": " + issue.Message
+}
+
+// Lint checks every template under templates/ for the errors that would
+// otherwise only surface when a visitor hits the page:
+//
+// - HTML templates that fail to parse with the real FuncMap.
+//
+// - main_template and include files in a templates-config that do not exist.
+//
+// - {{ template }} invocations that reference an undefined template.
+//
+// - Unknown Content-Security-Policy directive names and sanitize policies.
+//
+// The returned error is only non-nil if linting itself could not be carried
+// out.
+func (pm *PageManager) Lint() ([]LintIssue, error) {
+	var issues []LintIssue
+	var htmlfiles, configfiles []string
+	err := fs.WalkDir(pm.fsys, "templates", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		switch base := path.Base(name); {
+		case base == "templates-config.toml" || base == "templates-config.js":
+			configfiles = append(configfiles, name)
+		case strings.HasSuffix(base, ".html"):
+			htmlfiles = append(htmlfiles, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return issues, erro.Wrap(err)
+	}
+	fsys := pm.renderly.Fsys()
+	// Parse every HTML template on its own
+	brokenfiles := make(map[string]bool)
+	funcmap := pm.FuncMap()
+	for _, name := range htmlfiles {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return issues, erro.Wrap(err)
+		}
+		_, err = template.New(name).Funcs(funcmap).Parse(string(b))
+		if err != nil {
+			brokenfiles[name] = true
+			issues = append(issues, LintIssue{File: name, Message: err.Error()})
+		}
+	}
+	// Check every templates-config entry
+	includedfiles := make(map[string]bool)
+	for _, configfile := range configfiles {
+		entries, err := LoadTemplateConfig(pm.fsys, configfile)
+		if err != nil {
+			issues = append(issues, LintIssue{File: configfile, Message: err.Error()})
+			continue
+		}
+		names := make([]string, 0, len(entries))
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			metadata := entries[name]
+			where := configfile + ` ["` + name + `"]`
+			missing := false
+			for _, file := range append([]string{name, metadata.MainTemplate}, metadata.Include...) {
+				if file == "" {
+					continue
+				}
+				includedfiles[file] = true
+				if _, err := fs.Stat(fsys, file); err != nil {
+					missing = true
+					issues = append(issues, LintIssue{File: where, Message: fmt.Sprintf("%s does not exist", file)})
+				}
+			}
+			var policies []string
+			for policy := range metadata.CSP {
+				if _, ok := cspDirectives[policy]; !ok {
+					policies = append(policies, policy)
+				}
+			}
+			sort.Strings(policies)
+			for _, policy := range policies {
+				issues = append(issues, LintIssue{File: where, Message: fmt.Sprintf("unknown content_security_policy directive %q", policy)})
+			}
+			var fields []string
+			for field := range metadata.Sanitize {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			for _, field := range fields {
+				if _, ok := pm.policies[metadata.Sanitize[field]]; !ok {
+					issues = append(issues, LintIssue{File: where, Message: fmt.Sprintf("unknown sanitize policy %q for %s", metadata.Sanitize[field], field)})
+				}
+			}
+			if missing {
+				continue
+			}
+			mainfile, includefiles := metadata.Name, metadata.Include
+			if metadata.MainTemplate != "" {
+				mainfile = metadata.MainTemplate
+				includefiles = append([]string{metadata.Name}, includefiles...)
+			}
+			if brokenfiles[mainfile] || anyBroken(brokenfiles, includefiles) {
+				continue
+			}
+			_, err = pm.renderly.Lookup(mainfile, includefiles...)
+			if err != nil {
+				issues = append(issues, LintIssue{File: where, Message: err.Error()})
+			}
+		}
+	}
+	// Check every theme's settings declaration
+	themes := make(map[string]bool)
+	for _, configfile := range configfiles {
+		dir := path.Dir(configfile)
+		if path.Dir(dir) != "templates" || themes[dir] {
+			continue
+		}
+		themes[dir] = true
+		_, err = GetThemeSettings(pm.fsys, path.Base(dir))
+		if err != nil {
+			issues = append(issues, LintIssue{File: configfile, Message: err.Error()})
+		}
+	}
+	// HTML templates that are not part of any templates-config entry are
+	// rendered on their own, so they must resolve all of their dependencies
+	// by themselves.
+	for _, name := range htmlfiles {
+		if includedfiles[name] || brokenfiles[name] {
+			continue
+		}
+		_, err = pm.renderly.Lookup(name)
+		if err != nil {
+			issues = append(issues, LintIssue{File: name, Message: err.Error()})
+		}
+	}
+	return issues, nil
+}
+
+func anyBroken(brokenfiles map[string]bool, names []string) bool {
+	for _, name := range names {
+		if brokenfiles[name] {
+			return true
+		}
+	}
+	return false
+}
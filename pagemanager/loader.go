@@ -0,0 +1,312 @@
+package pagemanager
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+)
+
+// loaderEnvKey is the HTML env key holding the dataLoader of the current
+// render.
+const loaderEnvKey = "pm.loader"
+
+// dataLoader loads pm_templatedata for a single render. Each ID is fetched
+// from the database at most once, no matter how many template functions read
+// from it, and its parsed JSON is memoized for the rest of the render.
+//
+// A dataLoader is not safe for concurrent use, which is fine as templates are
+// executed sequentially.
+type dataLoader struct {
+	db     *sql.DB
+	column string
+	cache  map[string]loadedData
+	media  map[string]string // media ID to path, see mediaPath
+}
+
+type loadedData struct {
+	value   interface{}
+	exists  bool   // false if the ID has no row or its data is NULL
+	version string // see dataVersion
+}
+
+// dataVersion formats the updated_at of a pm_templatedata row as the version
+// of its data that the editor sends back with a save (see serveSave). It is
+// empty if there is no row or the row was never saved.
+func dataVersion(updatedAt sql.NullTime) string {
+	if !updatedAt.Valid {
+		return ""
+	}
+	return updatedAt.Time.UTC().Format(time.RFC3339Nano)
+}
+
+// loaderEnvFunc attaches a fresh dataLoader to the HTML env of every render.
+func (pm *PageManager) loaderEnvFunc(w io.Writer, r *http.Request, env map[string]interface{}) error {
+	l := &dataLoader{
+		db:     pm.db,
+		column: dataColumn(env),
+		cache:  make(map[string]loadedData),
+	}
+	env[loaderEnvKey] = l
+	if rec, ok := w.(*versionsRecorder); ok {
+		rec.loader = l
+	}
+	return nil
+}
+
+// loader returns the dataLoader of the render that env belongs to. Templates
+// rendered without one (e.g. when linting) get a loader that only lives as
+// long as the current call.
+func (pm *PageManager) loader(env map[string]interface{}) *dataLoader {
+	if l, ok := env[loaderEnvKey].(*dataLoader); ok {
+		return l
+	}
+	return &dataLoader{
+		db:     pm.db,
+		column: dataColumn(env),
+		cache:  make(map[string]loadedData),
+	}
+}
+
+// load returns the parsed data of id.
+func (l *dataLoader) load(id string) (loadedData, error) {
+	if data, ok := l.cache[id]; ok {
+		return data, nil
+	}
+	var data loadedData
+	var s sql.NullString
+	var updatedAt sql.NullTime
+	err := l.db.QueryRow("SELECT "+l.column+", updated_at FROM pm_templatedata WHERE id = ?", id).Scan(&s, &updatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return data, erro.Wrap(err)
+	}
+	data.version = dataVersion(updatedAt)
+	if s.Valid && strings.TrimSpace(s.String) != "" {
+		err = json.Unmarshal([]byte(s.String), &data.value)
+		if err != nil {
+			return data, erro.Wrap(err)
+		}
+		data.exists = true
+	}
+	l.cache[id] = data
+	return data, nil
+}
+
+// mediaPath returns the path of the media with the given ID. The paths of
+// the whole media library are fetched in one query the first time a render
+// asks for one, so that a page showing many media does not query pm_media
+// for each of them.
+func (l *dataLoader) mediaPath(id string) (path string, ok bool, err error) {
+	if l.media == nil {
+		media := make(map[string]string)
+		rows, err := l.db.Query("SELECT media_id, path FROM pm_media")
+		if err != nil {
+			return "", false, erro.Wrap(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id, path string
+			err = rows.Scan(&id, &path)
+			if err != nil {
+				return "", false, erro.Wrap(err)
+			}
+			media[id] = path
+		}
+		err = rows.Err()
+		if err != nil {
+			return "", false, erro.Wrap(err)
+		}
+		l.media = media
+	}
+	path, ok = l.media[id]
+	return path, ok, nil
+}
+
+// versions returns the version of every ID loaded so far.
+func (l *dataLoader) versions() map[string]string {
+	versions := make(map[string]string, len(l.cache))
+	for id, data := range l.cache {
+		versions[id] = data.version
+	}
+	return versions
+}
+
+// versionsRecorder buffers an edit mode render, so that the versions of the
+// IDs read by the render can be added to the page once it is done (see
+// flush).
+type versionsRecorder struct {
+	http.ResponseWriter
+	buf    bytes.Buffer
+	status int
+	loader *dataLoader
+}
+
+func (rec *versionsRecorder) Write(b []byte) (int, error) { return rec.buf.Write(b) }
+
+func (rec *versionsRecorder) WriteHeader(status int) { rec.status = status }
+
+// flush writes the buffered page to the underlying ResponseWriter with the
+// versions of the IDs read by the render inserted before </body>, as the
+// JSON script #pm-versions. pagemanager.js sends them back with every save.
+func (rec *versionsRecorder) flush() error {
+	versions := make(map[string]string)
+	if rec.loader != nil {
+		versions = rec.loader.versions()
+	}
+	b, err := json.Marshal(versions)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	script := `<script type="application/json" id="pm-versions">` + string(b) + `</script>`
+	page := rec.buf.Bytes()
+	i := bytes.LastIndex(page, []byte("</body>"))
+	if i < 0 {
+		i = len(page)
+	}
+	if rec.status != 0 {
+		rec.ResponseWriter.WriteHeader(rec.status)
+	}
+	for _, chunk := range [][]byte{page[:i], []byte(script), page[i:]} {
+		_, err = rec.ResponseWriter.Write(chunk)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// lookup returns the value at the JSON path in the data of id. exists
+// reports whether the path is present at all, so that a missing value can be
+// told apart from an explicit null.
+func (l *dataLoader) lookup(id, path string) (value interface{}, exists bool, err error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, false, err
+	}
+	data, err := l.load(id)
+	if err != nil || !data.exists {
+		return nil, false, err
+	}
+	value = data.value
+	for _, step := range steps {
+		switch step := step.(type) {
+		case string:
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false, nil
+			}
+			value, ok = object[step]
+			if !ok {
+				return nil, false, nil
+			}
+		case int:
+			array, ok := value.([]interface{})
+			if !ok {
+				return nil, false, nil
+			}
+			if step < 0 {
+				step += len(array)
+			}
+			if step < 0 || step >= len(array) {
+				return nil, false, nil
+			}
+			value = array[step]
+		}
+	}
+	return value, true, nil
+}
+
+// parseJSONPath splits a JSON path in the syntax understood by SQLite's
+// json_extract into its object keys (strings) and array indexes (ints).
+// Indexes counting from the end of an array, written as [#-N], are returned
+// as negative numbers.
+//
+//	$.posts[0].title     => "posts", 0, "title"
+//	$."a.b"[#-1]         => "a.b", -1
+func parseJSONPath(path string) ([]interface{}, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("JSON path %q does not start with $", path)
+	}
+	var steps []interface{}
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			if strings.HasPrefix(rest, `"`) {
+				end := strings.IndexByte(rest[1:], '"')
+				if end < 0 {
+					return nil, fmt.Errorf("JSON path %q has an unterminated quoted key", path)
+				}
+				steps = append(steps, rest[1:end+1])
+				rest = rest[end+2:]
+				continue
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("JSON path %q has an empty key", path)
+			}
+			steps = append(steps, rest[:end])
+			rest = rest[end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("JSON path %q has an unterminated [", path)
+			}
+			index := rest[1:end]
+			rest = rest[end+1:]
+			fromEnd := strings.HasPrefix(index, "#-")
+			if fromEnd {
+				index = strings.TrimPrefix(index, "#-")
+			}
+			n, err := strconv.Atoi(index)
+			if err != nil || n < 0 || (fromEnd && n == 0) {
+				return nil, fmt.Errorf("JSON path %q has an invalid array index [%s]", path, index)
+			}
+			if fromEnd {
+				n = -n
+			}
+			steps = append(steps, n)
+		default:
+			return nil, fmt.Errorf("JSON path %q is malformed at %q", path, rest)
+		}
+	}
+	return steps, nil
+}
+
+// sqliteText formats a JSON value the way SQLite's json_extract returns it
+// as text: strings as they are, numbers without trailing zeroes, booleans as
+// 1 or 0 and objects and arrays as minified JSON.
+func sqliteText(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case bool:
+		if value {
+			return "1", nil
+		}
+		return "0", nil
+	default:
+		buf := &strings.Builder{}
+		encoder := json.NewEncoder(buf)
+		encoder.SetEscapeHTML(false)
+		err := encoder.Encode(value)
+		if err != nil {
+			return "", erro.Wrap(err)
+		}
+		return strings.TrimSuffix(buf.String(), "\n"), nil
+	}
+}
@@ -0,0 +1,64 @@
+package pagemanager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    []interface{}
+		wantErr bool
+	}{
+		{"$", nil, false},
+		{"$.title", []interface{}{"title"}, false},
+		{"$.posts[0].title", []interface{}{"posts", 0, "title"}, false},
+		{`$."a.b"[#-1]`, []interface{}{"a.b", -1}, false},
+		{"$[2][3]", []interface{}{2, 3}, false},
+		{"title", nil, true},
+		{"$.", nil, true},
+		{"$.a[", nil, true},
+		{"$.a[x]", nil, true},
+		{"$.a[-1]", nil, true},
+		{"$.a[#-0]", nil, true},
+		{`$."a`, nil, true},
+		{"$a", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseJSONPath(tt.path)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseJSONPath(%q) = %v, %v, want %v (error: %v)", tt.path, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestVersionsRecorderFlush(t *testing.T) {
+	w := httptest.NewRecorder()
+	rec := &versionsRecorder{ResponseWriter: w}
+	rec.loader = &dataLoader{cache: map[string]loadedData{
+		"/about":         {exists: true, version: "2021-01-02T03:04:05.123456789Z"},
+		"</script><x>":   {},
+		"mytheme-global": {exists: true, version: "2021-01-01T00:00:00Z"},
+	}}
+	rec.Header().Set("X-Test", "1")
+	rec.WriteHeader(http.StatusTeapot)
+	rec.Write([]byte("<html><body><p>hi</p></body></html>"))
+	if w.Body.Len() != 0 {
+		t.Fatal("the page was written before flush")
+	}
+	if err := rec.flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := `<html><body><p>hi</p><script type="application/json" id="pm-versions">` +
+		`{"/about":"2021-01-02T03:04:05.123456789Z","\u003c/script\u003e\u003cx\u003e":"","mytheme-global":"2021-01-01T00:00:00Z"}` +
+		`</script></body></html>`
+	if got := w.Body.String(); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+	if w.Code != http.StatusTeapot || w.Header().Get("X-Test") != "1" {
+		t.Errorf("status and headers were not passed through: %d %v", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,548 @@
+package pagemanager
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+	"github.com/google/uuid"
+)
+
+// mediaDir is the folder (inside uploadsDir) that files added to the media
+// library are stored in, named after their content hash.
+const mediaDir = uploadsDir + "/media"
+
+// Media is an uploaded file tracked in the media library.
+type Media struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"` // relative to the datafolder, e.g. pm-uploads/media/{hash}.jpg
+	Hash         string    `json:"hash"` // hex SHA-256 of the content
+	OriginalName string    `json:"original_name"`
+	MIMEType     string    `json:"mime_type"`
+	Size         int64     `json:"size"`
+	Width        int       `json:"width,omitempty"` // 0 if not an image
+	Height       int       `json:"height,omitempty"`
+	UploadedBy   string    `json:"uploaded_by"`
+	UploadedAt   time.Time `json:"uploaded_at"`
+
+	// OriginalID and Crop are set for images that were cropped by the
+	// editor: OriginalID is the media the image was cropped from.
+	OriginalID string      `json:"original_id,omitempty"`
+	Crop       *CropParams `json:"crop,omitempty"`
+
+	// MetadataStripped is whether EXIF, XMP and other metadata were removed
+	// from the file when it was uploaded (see stripMetadata).
+	MetadataStripped bool `json:"metadata_stripped"`
+}
+
+// URL returns the URL that m is served at.
+func (m Media) URL() string {
+	return "/static/" + m.Path
+}
+
+const mediaColumns = "media_id, path, hash, COALESCE(original_name, ''), COALESCE(mime_type, ''), size, COALESCE(width, 0), COALESCE(height, 0), COALESCE(uploaded_by, ''), uploaded_at, COALESCE(original_id, ''), COALESCE(crop, ''), COALESCE(metadata_stripped, FALSE)"
+
+func scanMedia(row interface{ Scan(...interface{}) error }) (Media, error) {
+	var m Media
+	var crop string
+	err := row.Scan(&m.ID, &m.Path, &m.Hash, &m.OriginalName, &m.MIMEType, &m.Size, &m.Width, &m.Height, &m.UploadedBy, &m.UploadedAt, &m.OriginalID, &crop, &m.MetadataStripped)
+	if err != nil {
+		return m, err
+	}
+	if crop != "" {
+		m.Crop = &CropParams{}
+		err = json.Unmarshal([]byte(crop), m.Crop)
+	}
+	return m, err
+}
+
+// uploadOptions are the details of an upload that recordUpload records
+// besides the file itself.
+type uploadOptions struct {
+	originalID       string      // the media the upload was cropped from
+	crop             *CropParams // how the upload was cropped
+	metadataStripped bool
+}
+
+// stagedUpload is an upload that was validated and prepared but not yet
+// written, see uploadBatch.
+type stagedUpload struct {
+	name         string // relative to the datafolder
+	originalName string
+	b            []byte
+	opts         uploadOptions
+	original     *stagedUpload // the original the upload is cropped from, if any
+
+	// media is the media library record of the upload. It is set once the
+	// upload is recorded, or right away for media that is already in the
+	// media library (in which case stored is true and b is nil).
+	media  Media
+	stored bool
+
+	before  []byte // the previous contents of name, restored if the batch fails
+	existed bool
+	written bool
+}
+
+// uploadBatch holds the uploads of a single request, so that they are
+// recorded in the media library within the same transaction as the other
+// changes of the request, and their files are only written once everything
+// else has succeeded (see storeUploads).
+type uploadBatch struct {
+	uploads []*stagedUpload
+}
+
+// stage adds b to batch, to be stored at name (relative to the datafolder).
+// Staging the same name twice replaces the bytes staged before.
+func (pm *PageManager) stage(ctx context.Context, batch *uploadBatch, name, originalName string, b []byte, opts uploadOptions) (*stagedUpload, error) {
+	for _, u := range batch.uploads {
+		if u.name == name {
+			u.originalName, u.b, u.opts, u.original = originalName, b, opts, nil
+			return u, nil
+		}
+	}
+	before, existed, err := readStorage(ctx, pm.storage, name)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	u := &stagedUpload{
+		name:         name,
+		originalName: originalName,
+		b:            b,
+		opts:         opts,
+		before:       before,
+		existed:      existed,
+	}
+	batch.uploads = append(batch.uploads, u)
+	return u, nil
+}
+
+// storeUploads runs fn (if not nil) and records the uploads of batch in the
+// media library, all in a single transaction. The files are written last,
+// right before the transaction is committed; if writing any of them or the
+// commit fails, the files already written are restored to their previous
+// contents, so that either the whole request is saved or none of it is.
+func (pm *PageManager) storeUploads(ctx context.Context, batch *uploadBatch, fn func(tx *sql.Tx) error) error {
+	err := pm.withTx(ctx, func(tx *sql.Tx) error {
+		if fn != nil {
+			err := fn(tx)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		for _, u := range batch.uploads {
+			if u.original != nil {
+				u.opts.originalID = u.original.media.ID
+			}
+			m, err := recordUpload(ctx, tx, u.name, u.originalName, u.b, u.opts, contentHash(u.before, u.existed))
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			u.media = m
+		}
+		for _, u := range batch.uploads {
+			err := pm.storage.Put(ctx, u.name, bytes.NewReader(u.b))
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			u.written = true
+		}
+		return nil
+	})
+	if err != nil {
+		for _, u := range batch.uploads {
+			if !u.written {
+				continue
+			}
+			var rerr error
+			if u.existed {
+				rerr = pm.storage.Put(ctx, u.name, bytes.NewReader(u.before))
+			} else {
+				rerr = pm.storage.Delete(ctx, u.name)
+			}
+			if rerr != nil {
+				log.Printf("restoring %s after a failed save: %v\n", u.name, rerr)
+			}
+			u.written = false
+		}
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// recordUpload records b, uploaded to name (relative to the datafolder), in
+// the media library, updating the existing record if a file was already
+// uploaded to name. The change is recorded in the audit log against
+// beforeHash, the content hash of the file being replaced.
+func recordUpload(ctx context.Context, tx *sql.Tx, name, originalName string, b []byte, opts uploadOptions, beforeHash string) (Media, error) {
+	m := Media{
+		Path:             name,
+		Hash:             contentHash(b, true),
+		OriginalName:     originalName,
+		MIMEType:         http.DetectContentType(b),
+		Size:             int64(len(b)),
+		UploadedBy:       authorFromContext(ctx),
+		UploadedAt:       time.Now().UTC(),
+		OriginalID:       opts.originalID,
+		Crop:             opts.crop,
+		MetadataStripped: opts.metadataStripped,
+	}
+	var cropJSON string
+	if m.Crop != nil {
+		b, err := json.Marshal(m.Crop)
+		if err != nil {
+			return m, erro.Wrap(err)
+		}
+		cropJSON = string(b)
+	}
+	if config, _, err := image.DecodeConfig(bytes.NewReader(b)); err == nil {
+		m.Width, m.Height = config.Width, config.Height
+	}
+	query := `INSERT INTO pm_media (media_id, path, hash, original_name, mime_type, size, width, height, uploaded_by, uploaded_at, original_id, crop, metadata_stripped)
+		VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, 0), NULLIF(?, 0), ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?)
+		ON CONFLICT (path) DO UPDATE SET
+			hash = EXCLUDED.hash,
+			original_name = EXCLUDED.original_name,
+			mime_type = EXCLUDED.mime_type,
+			size = EXCLUDED.size,
+			width = EXCLUDED.width,
+			height = EXCLUDED.height,
+			uploaded_by = EXCLUDED.uploaded_by,
+			uploaded_at = EXCLUDED.uploaded_at,
+			original_id = EXCLUDED.original_id,
+			crop = EXCLUDED.crop,
+			metadata_stripped = EXCLUDED.metadata_stripped`
+	_, err := tx.ExecContext(ctx, query, uuid.New().String(), m.Path, m.Hash, m.OriginalName, m.MIMEType, m.Size, m.Width, m.Height, m.UploadedBy, m.UploadedAt, m.OriginalID, cropJSON, m.MetadataStripped)
+	if err != nil {
+		return m, erro.Wrap(err)
+	}
+	err = tx.QueryRowContext(ctx, "SELECT media_id FROM pm_media WHERE path = ?", m.Path).Scan(&m.ID)
+	if err != nil {
+		return m, erro.Wrap(err)
+	}
+	err = audit(ctx, tx, AuditUpload, "file:"+name, beforeHash, m.Hash)
+	if err != nil {
+		return m, erro.Wrap(err)
+	}
+	return m, nil
+}
+
+// AddMedia adds the contents of src to the media library, storing it under
+// mediaDir named after its content hash. Adding a file that is already in
+// the media library returns the existing Media. originalName is normalized
+// with normalizeFilename. Metadata is stripped from the file unless
+// keepMetadata is set. If the file breaks the upload rules, the returned
+// error is an *UploadError.
+func (pm *PageManager) AddMedia(ctx context.Context, originalName string, src io.Reader, keepMetadata bool) (Media, error) {
+	batch := &uploadBatch{}
+	u, err := pm.stageMedia(ctx, batch, originalName, src, keepMetadata)
+	if err != nil {
+		return Media{}, err
+	}
+	err = pm.storeUploads(ctx, batch, nil)
+	if err != nil {
+		return Media{}, erro.Wrap(err)
+	}
+	return u.media, nil
+}
+
+// stageMedia is the part of AddMedia that validates and prepares the file,
+// adding it to batch unless it is already in the media library (or in
+// batch). If the file breaks the upload rules, the returned error is an
+// *UploadError.
+func (pm *PageManager) stageMedia(ctx context.Context, batch *uploadBatch, originalName string, src io.Reader, keepMetadata bool) (*stagedUpload, error) {
+	b, err := io.ReadAll(io.LimitReader(src, *uploadMaxFileSize+1))
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	originalName = normalizeFilename(originalName)
+	if uerr := validateUpload(originalName, b); uerr != nil {
+		return nil, uerr
+	}
+	b, stripped, uerr := prepareUpload(originalName, b, keepMetadata)
+	if uerr != nil {
+		return nil, uerr
+	}
+	ext := strings.ToLower(path.Ext(originalName))
+	if ext == "" {
+		mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(b))
+		if exts := uploadExtensions[mimeType]; len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	name := mediaDir + "/" + contentHash(b, true) + ext
+	for _, u := range batch.uploads {
+		if u.name == name {
+			return u, nil
+		}
+	}
+	m, ok, err := pm.GetMediaByPath(ctx, name)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	if ok {
+		return &stagedUpload{name: name, media: m, stored: true}, nil
+	}
+	return pm.stage(ctx, batch, name, originalName, b, uploadOptions{metadataStripped: stripped})
+}
+
+// ListMedia returns every file in the media library, newest first.
+func (pm *PageManager) ListMedia(ctx context.Context) ([]Media, error) {
+	rows, err := pm.db.QueryContext(ctx, "SELECT "+mediaColumns+" FROM pm_media ORDER BY uploaded_at DESC, path")
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	defer rows.Close()
+	var media []Media
+	for rows.Next() {
+		m, err := scanMedia(rows)
+		if err != nil {
+			return media, erro.Wrap(err)
+		}
+		media = append(media, m)
+	}
+	err = rows.Err()
+	if err != nil {
+		return media, erro.Wrap(err)
+	}
+	return media, nil
+}
+
+// GetMediaByPath returns the media stored at path (relative to the
+// datafolder). ok is false if there is no such media.
+func (pm *PageManager) GetMediaByPath(ctx context.Context, path string) (m Media, ok bool, err error) {
+	m, err = scanMedia(pm.db.QueryRowContext(ctx, "SELECT "+mediaColumns+" FROM pm_media WHERE path = ?", path))
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, erro.Wrap(err)
+	}
+	return m, true, nil
+}
+
+// GetMedia returns the media with the given ID. ok is false if there is no
+// such media.
+func (pm *PageManager) GetMedia(ctx context.Context, id string) (m Media, ok bool, err error) {
+	m, err = scanMedia(pm.db.QueryRowContext(ctx, "SELECT "+mediaColumns+" FROM pm_media WHERE media_id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, erro.Wrap(err)
+	}
+	return m, true, nil
+}
+
+// errMediaInUse is returned by DeleteMedia for media that images were
+// cropped from.
+var errMediaInUse = errors.New("images have been cropped from this media, delete them first")
+
+// DeleteMedia deletes the media with the given ID and its file. ok is false
+// if there is no such media. Media that other media were cropped from (see
+// Media.OriginalID) cannot be deleted until the crops are: DeleteMedia
+// returns errMediaInUse for it. The file is only deleted once the row
+// deletion has been committed; if deleting it fails, it is logged and left
+// for CollectGarbage to delete as an untracked upload.
+func (pm *PageManager) DeleteMedia(ctx context.Context, id string) (ok bool, err error) {
+	m, ok, err := pm.GetMedia(ctx, id)
+	if err != nil || !ok {
+		return ok, err
+	}
+	var inUse bool
+	err = pm.withTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM pm_media WHERE original_id = ?)", id).Scan(&inUse)
+		if err != nil || inUse {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM pm_media WHERE media_id = ?", id)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		return audit(ctx, tx, AuditDelete, "file:"+m.Path, m.Hash, "")
+	})
+	if err != nil {
+		return true, erro.Wrap(err)
+	}
+	if inUse {
+		return true, errMediaInUse
+	}
+	err = pm.storage.Delete(ctx, m.Path)
+	if err != nil {
+		log.Printf("deleting the file of media %s: %v\n", id, err)
+	}
+	return true, nil
+}
+
+// mediaURL returns the URL of the media with the given ID, e.g.
+//
+//	<img src="{{ mediaURL .Env (getString .Env "hero.media_id" "") "/static/templates/plainsimple/hero.jpg" }}">
+//
+// If there is no such media (e.g. it has been deleted from the library) the
+// page is still rendered: mediaURL logs it and returns the optional fallback
+// URL, or "".
+func (pm *PageManager) mediaURL(env map[string]interface{}, id string, fallback ...string) (string, error) {
+	var def string
+	if len(fallback) > 0 {
+		def = fallback[0]
+	}
+	if id == "" {
+		return def, nil
+	}
+	p, ok, err := pm.loader(env).mediaPath(id)
+	if err != nil {
+		return def, err
+	}
+	if !ok {
+		log.Printf("mediaURL: no media with ID %q\n", id)
+		return def, nil
+	}
+	if prefix, ok := env["StaticPrefix"].(string); ok {
+		return prefix + "/" + p, nil
+	}
+	return Media{Path: p}.URL(), nil
+}
+
+// serveMedia serves the media library API:
+//
+//	GET    /pm-media      list media (only the media at ?path={path} if given)
+//	POST   /pm-media      add the files of a multipart form to the media library
+//	                      (keeping their metadata if the form has keep_metadata=true)
+//	GET    /pm-media/{id} get a media
+//	DELETE /pm-media/{id} delete a media and its file (409 Conflict if images
+//	                      were cropped from it)
+func (pm *PageManager) serveMedia(w http.ResponseWriter, r *http.Request) {
+	ctx := requestContext(r)
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/pm-media"), "/")
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			var media []Media
+			var err error
+			if p := r.URL.Query().Get("path"); p != "" {
+				var m Media
+				var ok bool
+				m, ok, err = pm.GetMediaByPath(ctx, strings.TrimPrefix(p, "/static/"))
+				if ok {
+					media = append(media, m)
+				}
+			} else {
+				media, err = pm.ListMedia(ctx)
+			}
+			if err != nil {
+				http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+				return
+			}
+			if media == nil {
+				media = []Media{}
+			}
+			writeJSON(w, http.StatusOK, media)
+		case http.MethodPost:
+			limitUploadRequest(w, r)
+			err := r.ParseMultipartForm(32 << 20)
+			if uerr := requestTooLarge(r, err); uerr != nil {
+				writeUploadError(w, uerr)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Check every file before adding any of them, so that a
+			// rejected file does not leave the others half uploaded: every
+			// file is validated and staged in one batch, which is only
+			// stored once all of them pass. The names of media library files
+			// are normalized rather than checked, since they are never
+			// referenced by their original name.
+			for _, headers := range r.MultipartForm.File {
+				for _, header := range headers {
+					if uerr := checkUploadSize(header.Filename, header.Size); uerr != nil {
+						writeUploadError(w, uerr)
+						return
+					}
+				}
+			}
+			batch := &uploadBatch{}
+			var staged []*stagedUpload
+			for _, headers := range r.MultipartForm.File {
+				for _, header := range headers {
+					f, err := header.Open()
+					if err != nil {
+						http.Error(w, erro.Sdump(err), http.StatusBadRequest)
+						return
+					}
+					u, err := pm.stageMedia(ctx, batch, header.Filename, f, r.FormValue("keep_metadata") == "true")
+					f.Close()
+					if uerr, ok := err.(*UploadError); ok {
+						writeUploadError(w, uerr)
+						return
+					}
+					if err != nil {
+						http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+						return
+					}
+					staged = append(staged, u)
+				}
+			}
+			err = pm.storeUploads(ctx, batch, nil)
+			if err != nil {
+				http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+				return
+			}
+			media := make([]Media, len(staged))
+			for i, u := range staged {
+				media[i] = u.media
+			}
+			writeJSON(w, http.StatusOK, media)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		m, ok, err := pm.GetMedia(ctx, id)
+		if err != nil {
+			http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, m)
+	case http.MethodDelete:
+		ok, err := pm.DeleteMedia(ctx, id)
+		if errors.Is(err, errMediaInUse) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
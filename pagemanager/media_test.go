@@ -0,0 +1,82 @@
+package pagemanager
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestDeleteMedia(t *testing.T) {
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	for _, m := range []struct{ id, path, originalID string }{
+		{"original", mediaDir + "/original.png", ""},
+		{"crop", mediaDir + "/crop.png", "original"},
+	} {
+		_, err := pm.db.Exec("INSERT INTO pm_media (media_id, path, hash, size, uploaded_at, original_id) VALUES (?, ?, 'hash', 4, CURRENT_TIMESTAMP, NULLIF(?, ''))", m.id, m.path, m.originalID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = pm.writeFile(ctx, m.path, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ok, err := pm.DeleteMedia(ctx, "missing")
+	if err != nil || ok {
+		t.Errorf("deleting missing media: got %v, %v, want false, nil", ok, err)
+	}
+	_, err = pm.DeleteMedia(ctx, "original")
+	if !errors.Is(err, errMediaInUse) {
+		t.Errorf("deleting media with crops: got %v, want errMediaInUse", err)
+	}
+	if _, ok, _ := pm.GetMedia(ctx, "original"); !ok {
+		t.Errorf("media with crops was deleted")
+	}
+	ok, err = pm.DeleteMedia(ctx, "crop")
+	if err != nil || !ok {
+		t.Fatalf("deleting a crop: got %v, %v, want true, nil", ok, err)
+	}
+	if _, err := pm.storage.Stat(ctx, mediaDir+"/crop.png"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the file of a deleted crop was not deleted: %v", err)
+	}
+	ok, err = pm.DeleteMedia(ctx, "original")
+	if err != nil || !ok {
+		t.Errorf("deleting media whose crops were deleted: got %v, %v, want true, nil", ok, err)
+	}
+}
+
+func TestMediaURL(t *testing.T) {
+	pm := newTestPageManager(t)
+	_, err := pm.db.Exec("INSERT INTO pm_media (media_id, path, hash, size, uploaded_at) VALUES ('m1', ?, 'hash', 4, CURRENT_TIMESTAMP)", mediaDir+"/photo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := make(map[string]interface{})
+	err = pm.loaderEnvFunc(nil, nil, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := pm.mediaURL(env, "m1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/static/" + mediaDir + "/photo.png"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// The media library is loaded once per render.
+	_, err = pm.db.Exec("DELETE FROM pm_media")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = pm.mediaURL(env, "m1")
+	if err != nil || got != "/static/"+mediaDir+"/photo.png" {
+		t.Errorf("second lookup in the same render: got %s, %v", got, err)
+	}
+	got, err = pm.mediaURL(env, "missing", "/fallback.png")
+	if err != nil || got != "/fallback.png" {
+		t.Errorf("missing media: got %s, %v, want the fallback", got, err)
+	}
+}
@@ -3,7 +3,6 @@ package pagemanager
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -16,6 +15,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/bokwoon95/erro"
 	"github.com/bokwoon95/pagemanager-data/renderly"
@@ -31,32 +32,66 @@ import (
 var pagemanagerFS fs.FS
 
 func init() {
-	flag.Parse()
 	if pagemanagerFS == nil {
 		pagemanagerFS = os.DirFS(renderly.AbsDir("."))
 	}
 }
 
 type PageManager struct {
-	dbdriver   string
-	db         *sql.DB
-	routemap   map[string]Route
-	routecache *ristretto.Cache // TODO: make this a Cache interface instead
-	restart    chan struct{}
-	fsys       fs.FS
-	fsysprefix string
-	fsHandler  http.Handler
-	notfound   http.Handler
-	renderly   *renderly.Renderly
-	htmlPolicy *bluemonday.Policy
-
-	firsttime     bool
+	datafolder     string
+	dbdriver       string
+	db             *sql.DB
+	routemap       map[string]Route
+	routecache     *ristretto.Cache // TODO: make this a Cache interface instead
+	fsys           fs.FS
+	storage        Storage // where uploads are stored, served as part of fsys
+	fsysprefix     string
+	fsHandler      http.Handler
+	notfound       http.Handler
+	renderly       *renderly.Renderly
+	htmlPolicy     *bluemonday.Policy
+	policies       map[string]*bluemonday.Policy
+	videoProviders map[string]VideoProvider // enabled by -pm-video-providers
+	searchErr      error                    // why search is unavailable, nil if it is available
+
+	// collections caches pm_collections for matchCollection, which runs on
+	// every request that no route matches. It is loaded on first use and
+	// cleared whenever a collection is written (see invalidateCollections).
+	collectionsMu     sync.RWMutex
+	collections       []Collection
+	collectionsLoaded bool
+
+	// linkReport caches the report served by serveLinks for linkReportMaxAge,
+	// since checking links renders every page and sends requests to the
+	// mounted handler. linksMu also keeps serveLinks from running several
+	// checks at once.
+	linksMu    sync.Mutex
+	linkReport *LinkReport
+
+	// Every PageManager set up by Reload shares the live state of the
+	// PageManager returned by New.
+	live     *liveState
+	inflight sync.RWMutex // held for reading by requests served with this state
+	retired  bool         // replaced by Reload and no longer serving requests
+
 	trailingslash bool
 }
 
+// liveState tracks which PageManager requests through Middleware are
+// currently served with.
+type liveState struct {
+	current  atomic.Value // *PageManager
+	root     *PageManager // the PageManager returned by New
+	reloadMu sync.Mutex   // one Reload at a time
+}
+
 func New() (*PageManager, error) {
+	// Flags are parsed here rather than in an init func so that the flags
+	// of test binaries are registered by the time they are parsed.
+	if !flag.Parsed() {
+		flag.Parse()
+	}
 	pm := &PageManager{}
-	pm.firsttime = true
 	err := pm.Setup()
 	if err != nil {
 		return pm, erro.Wrap(err)
@@ -66,7 +101,6 @@ func New() (*PageManager, error) {
 
 func (pm *PageManager) Setup() error {
 	pm.routemap = make(map[string]Route)
-	pm.restart = make(chan struct{}, 1)
 	pm.notfound = http.NotFoundHandler()
 	datafolder, err := LocateDataFolder()
 	if err != nil {
@@ -75,9 +109,29 @@ func (pm *PageManager) Setup() error {
 	if datafolder == "" {
 		return fmt.Errorf("couldn't locate PageManager datafolder")
 	}
+	pm.datafolder = datafolder
 	// fsys
+	// A reloaded PageManager keeps the storage of the one it replaces, which
+	// may hold the only copy of the uploads (-pm-storage memory).
+	if pm.storage == nil {
+		pm.storage, err = newStorage(datafolder)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
 	pm.fsys = os.DirFS(datafolder)
+	if _, ok := pm.storage.(*LocalStorage); !ok {
+		pm.fsys = uploadsOverlayFS{datafolder: pm.fsys, uploads: storageFS{storage: pm.storage}}
+	}
 	pm.fsHandler = http.FileServer(http.FS(pm.fsys))
+	pm.videoProviders, err = newVideoProviders(*videoProviders)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = checkUploadTypes()
+	if err != nil {
+		return erro.Wrap(err)
+	}
 	// db
 	pm.dbdriver = "sqlite3"
 	pm.db, err = sql.Open(pm.dbdriver, datafolder+string(os.PathSeparator)+"database.sqlite3")
@@ -104,6 +158,11 @@ func (pm *PageManager) Setup() error {
 	if err != nil {
 		return erro.Wrap(err)
 	}
+	// search
+	err = pm.setupSearch(context.Background())
+	if err != nil {
+		return erro.Wrap(err)
+	}
 	// cache
 	pm.routecache, err = ristretto.NewCache(&ristretto.Config{
 		NumCounters: 1e7,     // number of keys to track frequency of (10M).
@@ -120,7 +179,7 @@ func (pm *PageManager) Setup() error {
 		renderly.AddFS("pagemanager", pagemanagerFS),
 		renderly.TemplateFuncs(pm.FuncMap()),
 		renderly.GlobalCSS("pagemanager::tachyons.css"),
-		renderly.GlobalHTMLEnvFuncs(pm.EnvFunc),
+		renderly.GlobalHTMLEnvFuncs(pm.EnvFunc, pm.loaderEnvFunc, pm.responseWriterEnvFunc),
 		renderly.GlobalJSEnvFuncs(pm.EnvFunc),
 	)
 	if err != nil {
@@ -129,41 +188,41 @@ func (pm *PageManager) Setup() error {
 	// bluemonday
 	pm.htmlPolicy = bluemonday.UGCPolicy()
 	pm.htmlPolicy.AllowStyling()
+	pm.policies = newPolicies(pm.htmlPolicy)
+	// live
+	if pm.live == nil {
+		pm.live = &liveState{root: pm}
+		pm.live.current.Store(pm)
+	}
 	return nil
 }
 
-func (pm *PageManager) newmux(defaultHandler http.Handler) http.Handler {
+func (pm *PageManager) newmux(defaultHandler http.Handler) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle("/", defaultHandler)
 	mux.HandleFunc("/restart", func(w http.ResponseWriter, r *http.Request) {
-		select {
-		case pm.restart <- struct{}{}:
-		default:
-		}
-	})
-	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
-		_ = r.ParseMultipartForm(10 << 20)
-		a := r.FormValue("/image")
-		b := r.FormValue("imagecanvas-globals")
-		cFile, cHeader, err := r.FormFile("imgs[]")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer cFile.Close()
-		f, err := os.OpenFile("./templates/imagecanvas/image.jpg", os.O_WRONLY|os.O_CREATE, 0666)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer f.Close()
-		_, _ = io.Copy(f, cFile)
-		_, err = pm.db.Exec("INSERT INTO pm_templatedata (id, data) VALUES (?, ?), (?, ?) ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data", "/image", a, "imagecanvas-globals", b)
+		err := pm.Reload()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
 			return
 		}
-		_ = cHeader
+		io.WriteString(w, "reloaded\n")
+	})
+	mux.HandleFunc("/pm-settings/", pm.serveSettings)
+	mux.HandleFunc("/pm-save", pm.serveSave)
+	mux.HandleFunc("/pm-publish", pm.servePublish)
+	mux.HandleFunc("/pm-revisions", pm.serveRevisions)
+	mux.HandleFunc("/pm-revisions/", pm.serveRevisions)
+	mux.HandleFunc("/pm-search", pm.serveSearch)
+	mux.HandleFunc("/pm-collections", pm.serveCollections)
+	mux.HandleFunc("/pm-collections/", pm.serveCollections)
+	mux.HandleFunc("/pm-export", pm.serveExport)
+	mux.HandleFunc("/pm-import", pm.serveImport)
+	mux.HandleFunc("/pm-audit", pm.serveAudit)
+	mux.HandleFunc("/pm-media", pm.serveMedia)
+	mux.HandleFunc("/pm-media/", pm.serveMedia)
+	mux.HandleFunc("/pm-links", func(w http.ResponseWriter, r *http.Request) {
+		pm.serveLinks(w, r, defaultHandler)
 	})
 	return mux
 }
@@ -211,8 +270,90 @@ func (pm *PageManager) getroute(path string) (Route, error) {
 	return route, nil
 }
 
+// Middleware serves PageManager pages and endpoints, passing everything else
+// on to next. The returned handler stays the same across calls to Reload:
+// each request is served with whichever state is current when it arrives.
 func (pm *PageManager) Middleware(next http.Handler) http.Handler {
-	mux := pm.renderly.FileServerMiddleware()(pm.newmux(next))
+	type stateHandler struct {
+		state   *PageManager
+		handler http.Handler
+	}
+	var cache atomic.Value // stateHandler of the most recent state
+	serve := func(w http.ResponseWriter, r *http.Request, state *PageManager) (served bool) {
+		state.inflight.RLock()
+		defer state.inflight.RUnlock()
+		if state.retired {
+			return false
+		}
+		cached, _ := cache.Load().(stateHandler)
+		if cached.state != state {
+			cached = stateHandler{state: state, handler: state.middleware(next)}
+			cache.Store(cached)
+		}
+		cached.handler.ServeHTTP(w, r)
+		return true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A state retired between loading and locking it has just been
+		// replaced, so the next load picks up its replacement.
+		for !serve(w, r, pm.live.current.Load().(*PageManager)) {
+		}
+	})
+}
+
+// Reload sets up a new PageManager (database connection, templates,
+// caches...) from the datafolder and flags, and then switches Middleware over
+// to it. Requests keep being served with the current state while the new one
+// is set up; if setting it up fails, the current state stays in place.
+//
+// The replaced state is closed once the requests still using it are done,
+// except for the PageManager returned by New, which is left open for code
+// that holds on to it.
+func (pm *PageManager) Reload() error {
+	live := pm.live
+	live.reloadMu.Lock()
+	defer live.reloadMu.Unlock()
+	old := live.current.Load().(*PageManager)
+	state := &PageManager{live: live, storage: old.storage}
+	err := state.Setup()
+	if err != nil {
+		state.close()
+		log.Printf("reload failed, still serving the previous state: %v\n", err)
+		return erro.Wrap(err)
+	}
+	live.current.Store(state)
+	log.Println("reloaded")
+	if old != live.root {
+		go old.retire()
+	}
+	return nil
+}
+
+// retire closes a state replaced by Reload once the requests being served
+// with it are done.
+func (pm *PageManager) retire() {
+	pm.inflight.Lock()
+	pm.retired = true
+	pm.inflight.Unlock()
+	pm.close()
+}
+
+// close releases the database connection and cache of a state that is not
+// serving requests.
+func (pm *PageManager) close() {
+	if pm.routecache != nil {
+		pm.routecache.Close()
+	}
+	if pm.db != nil {
+		if err := pm.db.Close(); err != nil {
+			log.Printf("closing the database of a replaced state: %v\n", err)
+		}
+	}
+}
+
+// middleware is the handler chain of Middleware for this state.
+func (pm *PageManager) middleware(next http.Handler) http.Handler {
+	mux := pm.imageVariantMiddleware(pm.renderly.FileServerMiddleware()(pm.newmux(next)))
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		route, err := pm.getroute(r.URL.Path)
 		if err != nil {
@@ -255,73 +396,82 @@ func (pm *PageManager) Middleware(next http.Handler) http.Handler {
 			editTemplate = route.Template.Valid
 		}
 		if route.Template.Valid {
-			metadata, err := GetTemplateMetadata(pm.fsys, route.Template.String) // TODO: cache the metadata
+			err = pm.renderTemplate(w, r, route.Template.String, editTemplate)
 			if err != nil {
 				http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
-				return
-			}
-			for policy, values := range metadata.CSP {
-				allvalues := strings.Join(values, " ")
-				_ = renderly.AppendCSP(w, policy, allvalues)
-			}
-			var mainfile = metadata.Name
-			var includefiles []string
-			if metadata.MainTemplate != "" {
-				mainfile = metadata.MainTemplate
-				includefiles = append(includefiles, metadata.Name)
-			}
-			includefiles = append(includefiles, metadata.Include...)
-			if editTemplate {
-				includefiles = append(includefiles, "pagemanager::pagemanager.js", "pagemanager::pagemanager.css")
-			}
-			data := make(map[string]interface{})
-			if len(metadata.Env) > 0 {
-				data["Env"] = metadata.Env
-			}
-			_ = r.ParseForm()
-			var jsonify bool
-			if _, ok := r.Form["json"]; ok {
-				jsonify = true
 			}
-			err = pm.renderly.Page(w, r, mainfile, includefiles, data, renderly.JSEnv(metadata.Env), renderly.JSONifyData(jsonify))
+			return
+		}
+		if !route.URL.Valid {
+			served, err := pm.serveCollectionPage(w, r)
 			if err != nil {
 				http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
 				return
 			}
-			return
+			if served {
+				return
+			}
 		}
 		mux.ServeHTTP(w, r)
 	})
 }
 
-func (pm *PageManager) ListenAndServe(addr string, handler http.Handler) error {
-	for {
-		if pm.firsttime {
-			pm.firsttime = false
-		} else {
-			fmt.Println("restarted")
-			err := pm.Setup()
-			if err != nil {
-				return erro.Wrap(err)
-			}
-		}
-		srv := http.Server{
-			Addr:    addr,
-			Handler: handler,
-		}
-		go func() {
-			<-pm.restart
-			if err := srv.Shutdown(context.Background()); err != nil {
-				log.Printf("srv.Shutdown error: %v\n", err)
-			}
-		}()
-		fmt.Println("Listening on " + addr)
-		err := srv.ListenAndServe()
-		if errors.Is(err, http.ErrServerClosed) {
-			continue
+// renderTemplate renders the page of the template called name (as configured
+// in its templates-config file). editTemplate includes the page editor.
+func (pm *PageManager) renderTemplate(w http.ResponseWriter, r *http.Request, name string, editTemplate bool, opts ...renderly.RenderOption) error {
+	metadata, err := GetTemplateMetadata(pm.fsys, name) // TODO: cache the metadata
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	for policy, values := range metadata.CSP {
+		allvalues := strings.Join(values, " ")
+		_ = renderly.AppendCSP(w, policy, allvalues)
+	}
+	var mainfile = metadata.Name
+	var includefiles []string
+	if metadata.MainTemplate != "" {
+		mainfile = metadata.MainTemplate
+		includefiles = append(includefiles, metadata.Name)
+	}
+	includefiles = append(includefiles, metadata.Include...)
+	if editTemplate {
+		includefiles = append(includefiles, "pagemanager::pagemanager.js", "pagemanager::pagemanager.css")
+	}
+	data := make(map[string]interface{})
+	if len(metadata.Env) > 0 {
+		data["Env"] = metadata.Env
+	}
+	_ = r.ParseForm()
+	var jsonify bool
+	if _, ok := r.Form["json"]; ok {
+		jsonify = true
+	}
+	opts = append([]renderly.RenderOption{renderly.JSEnv(metadata.Env), renderly.JSONifyData(jsonify)}, opts...)
+	if editTemplate {
+		rec := &versionsRecorder{ResponseWriter: w}
+		err = pm.renderly.Page(rec, r, mainfile, includefiles, data, opts...)
+		if err != nil {
+			return erro.Wrap(err)
 		}
+		return rec.flush()
+	}
+	err = pm.renderly.Page(w, r, mainfile, includefiles, data, opts...)
+	if err != nil {
 		return erro.Wrap(err)
 	}
+	return nil
+}
+
+// ListenAndServe serves handler on addr. /restart reloads the PageManager
+// (see Reload) without dropping the listener.
+func (pm *PageManager) ListenAndServe(addr string, handler http.Handler) error {
+	srv := http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+	fmt.Println("Listening on " + addr)
+	err := srv.ListenAndServe()
+	return erro.Wrap(err)
 }
 
 type TemplateMetadata struct {
@@ -330,6 +480,7 @@ type TemplateMetadata struct {
 	Include      []string               `json,toml,mapstructure:"include"`
 	CSP          map[string][]string    `json,toml,mapstructure:"content_security_policy"`
 	Env          map[string]interface{} `json,toml,mapstructure:"env"`
+	Sanitize     map[string]string      `json,toml,mapstructure:"sanitize"`
 }
 
 func GetTemplateMetadata(fsys fs.FS, filename string) (TemplateMetadata, error) {
@@ -361,24 +512,11 @@ func GetTemplateMetadata(fsys fs.FS, filename string) (TemplateMetadata, error)
 			return metadata, erro.Wrap(err)
 		}
 		if err == nil {
-			vm := goja.New()
-			vm.Set("log", func(f goja.FunctionCall) goja.Value {
-				a := make([]interface{}, len(f.Arguments))
-				for i := range f.Arguments {
-					a[i] = f.Argument(i).Export()
-				}
-				fmt.Println(a...)
-				return goja.Undefined()
-			})
-			res, err := vm.RunString("(function(){" + string(b) + "})()")
+			m, err := evalJSConfig(b)
 			if err != nil {
 				return metadata, erro.Wrap(err)
 			}
-			if res == nil {
-				return metadata, nil
-			}
-			m, ok := res.Export().(map[string]interface{})
-			if !ok {
+			if m == nil {
 				return metadata, nil
 			}
 			err = mapstructure.Decode(m[filename], &metadata)
@@ -414,6 +552,81 @@ func GetTemplateMetadata(fsys fs.FS, filename string) (TemplateMetadata, error)
 	return metadata, nil
 }
 
+// evalJSConfig runs the contents of a templates-config.js file and returns
+// the object it returns. A nil map is returned if the script does not return
+// an object.
+func evalJSConfig(b []byte) (map[string]interface{}, error) {
+	vm := goja.New()
+	vm.Set("log", func(f goja.FunctionCall) goja.Value {
+		a := make([]interface{}, len(f.Arguments))
+		for i := range f.Arguments {
+			a[i] = f.Argument(i).Export()
+		}
+		fmt.Println(a...)
+		return goja.Undefined()
+	})
+	res, err := vm.RunString("(function(){" + string(b) + "})()")
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	if res == nil {
+		return nil, nil
+	}
+	m, _ := res.Export().(map[string]interface{})
+	return m, nil
+}
+
+// LoadTemplateConfig reads every template entry declared in the
+// templates-config.toml or templates-config.js file at path. Only keys that
+// look like file paths (i.e. contain a slash) are treated as template
+// entries.
+func LoadTemplateConfig(fsys fs.FS, path string) (map[string]TemplateMetadata, error) {
+	b, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	entries := make(map[string]TemplateMetadata)
+	switch filepath.Ext(path) {
+	case ".js":
+		m, err := evalJSConfig(b)
+		if err != nil {
+			return nil, erro.Wrap(err)
+		}
+		for name, value := range m {
+			if !strings.Contains(name, "/") {
+				continue
+			}
+			metadata := TemplateMetadata{Name: name, Env: make(map[string]interface{})}
+			err = mapstructure.Decode(value, &metadata)
+			if err != nil {
+				return nil, erro.Wrap(err)
+			}
+			entries[name] = metadata
+		}
+	case ".toml":
+		mainTree, err := toml.LoadBytes(b)
+		if err != nil {
+			return nil, erro.Wrap(err)
+		}
+		for _, name := range mainTree.Keys() {
+			if !strings.Contains(name, "/") {
+				continue
+			}
+			subTree, _ := mainTree.GetPath([]string{name}).(*toml.Tree)
+			if subTree == nil {
+				continue
+			}
+			metadata := TemplateMetadata{Name: name, Env: make(map[string]interface{})}
+			err = subTree.Unmarshal(&metadata)
+			if err != nil {
+				return nil, erro.Wrap(err)
+			}
+			entries[name] = metadata
+		}
+	}
+	return entries, nil
+}
+
 // aliasing to dynamic URLs is not supported. If a plugin wishes to make a URL aliasable, it has to make the route static i.e. no :colon prefix, or {curly braces}/<angle brackets> delimiters.
 type Plugin interface {
 	HTTPHandler() (defaultPrefix string, handler http.Handler)
@@ -492,6 +705,7 @@ type table struct {
 	name        string
 	columns     []column
 	constraints []string
+	indexes     []string
 }
 
 func (t table) ddl() string {
@@ -543,6 +757,84 @@ var tables = []table{
 		columns: []column{
 			{name: "id", typ: "TEXT", constraints: []string{"NOT NULL", "PRIMARY KEY"}},
 			{name: "data", typ: "JSON"},
+			{name: "draft", typ: "JSON"},
+			{name: "updated_at", typ: "DATETIME"},
+		},
+	},
+	{
+		name: "pm_templatedata_revisions",
+		columns: []column{
+			{name: "revision_id", typ: "INTEGER", constraints: []string{"PRIMARY KEY", "AUTOINCREMENT"}},
+			{name: "id", typ: "TEXT", constraints: []string{"NOT NULL"}},
+			{name: "data", typ: "JSON"},
+			{name: "created_at", typ: "DATETIME"},
+			{name: "author", typ: "TEXT"},
+			{name: "published", typ: "BOOLEAN"},
+		},
+		indexes: []string{
+			"CREATE INDEX IF NOT EXISTS pm_templatedata_revisions_id_idx ON pm_templatedata_revisions (id, revision_id)",
+		},
+	},
+	{
+		name: "pm_collections",
+		columns: []column{
+			{name: "name", typ: "TEXT", constraints: []string{"NOT NULL", "PRIMARY KEY"}},
+			{name: "url_prefix", typ: "TEXT", constraints: []string{"NOT NULL", "UNIQUE"}},
+			{name: "index_template", typ: "TEXT"},
+			{name: "item_template", typ: "TEXT"},
+		},
+	},
+	{
+		name: "pm_collection_items",
+		columns: []column{
+			{name: "collection", typ: "TEXT", constraints: []string{"NOT NULL", "REFERENCES pm_collections (name) ON UPDATE CASCADE ON DELETE CASCADE"}},
+			{name: "slug", typ: "TEXT", constraints: []string{"NOT NULL"}},
+			{name: "fields", typ: "JSON"},
+			{name: "created_at", typ: "DATETIME"},
+			{name: "updated_at", typ: "DATETIME"},
+		},
+		constraints: []string{"PRIMARY KEY (collection, slug)"},
+		indexes: []string{
+			"CREATE INDEX IF NOT EXISTS pm_collection_items_created_at_idx ON pm_collection_items (collection, created_at)",
+		},
+	},
+	{
+		name: "pm_media",
+		columns: []column{
+			{name: "media_id", typ: "TEXT", constraints: []string{"NOT NULL", "PRIMARY KEY"}},
+			{name: "path", typ: "TEXT", constraints: []string{"NOT NULL", "UNIQUE"}},
+			{name: "hash", typ: "TEXT", constraints: []string{"NOT NULL"}},
+			{name: "original_name", typ: "TEXT"},
+			{name: "mime_type", typ: "TEXT"},
+			{name: "size", typ: "INTEGER", constraints: []string{"NOT NULL"}},
+			{name: "width", typ: "INTEGER"},
+			{name: "height", typ: "INTEGER"},
+			{name: "uploaded_by", typ: "TEXT"},
+			{name: "uploaded_at", typ: "DATETIME", constraints: []string{"NOT NULL"}},
+			{name: "original_id", typ: "TEXT"},
+			{name: "crop", typ: "JSON"},
+			{name: "metadata_stripped", typ: "BOOLEAN"},
+		},
+		indexes: []string{
+			"CREATE INDEX IF NOT EXISTS pm_media_hash_idx ON pm_media (hash)",
+		},
+	},
+	{
+		name: "pm_audit_log",
+		columns: []column{
+			{name: "audit_id", typ: "INTEGER", constraints: []string{"PRIMARY KEY", "AUTOINCREMENT"}},
+			{name: "created_at", typ: "DATETIME", constraints: []string{"NOT NULL"}},
+			{name: "actor", typ: "TEXT"},
+			{name: "remote_addr", typ: "TEXT"},
+			{name: "action", typ: "TEXT", constraints: []string{"NOT NULL"}},
+			{name: "target", typ: "TEXT", constraints: []string{"NOT NULL"}},
+			{name: "before_hash", typ: "TEXT"},
+			{name: "after_hash", typ: "TEXT"},
+		},
+		indexes: []string{
+			"CREATE INDEX IF NOT EXISTS pm_audit_log_target_idx ON pm_audit_log (target, audit_id)",
+			"CREATE INDEX IF NOT EXISTS pm_audit_log_actor_idx ON pm_audit_log (actor, audit_id)",
+			"CREATE INDEX IF NOT EXISTS pm_audit_log_created_at_idx ON pm_audit_log (created_at)",
 		},
 	},
 }
@@ -584,7 +876,7 @@ func ensuretables(driver string, db *sql.DB) error {
 			}
 			query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table.name, column.name, column.typ)
 			if len(column.constraints) > 0 {
-				query = query + strings.Join(column.constraints, " ")
+				query = query + " " + strings.Join(column.constraints, " ")
 			}
 			_, err = db.Exec(query)
 			if err != nil {
@@ -592,12 +884,32 @@ func ensuretables(driver string, db *sql.DB) error {
 			}
 		}
 	}
+	for _, table := range tables {
+		for _, index := range table.indexes {
+			_, err = db.Exec(index)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+	}
 	return nil
 }
 
 func (pm *PageManager) EnvFunc(w io.Writer, r *http.Request, env map[string]interface{}) error {
-	env["PageID"] = r.URL.Path
-	env["EditMode"] = strings.HasSuffix(r.URL.Path, "/edit") || strings.HasSuffix(r.URL.Path, "/edit/")
+	editMode := strings.HasSuffix(r.URL.Path, "/edit") || strings.HasSuffix(r.URL.Path, "/edit/")
+	pageID := r.URL.Path
+	if editMode {
+		// The page being edited is stored under the same ID as its public
+		// counterpart.
+		pageID = strings.TrimSuffix(strings.TrimSuffix(pageID, "/"), "/edit")
+		if pageID == "" {
+			pageID = "/"
+		}
+	}
+	env["PageID"] = pageID
+	env["EditMode"] = editMode
+	env["RequestURL"] = r.URL.String()
+	env["Query"] = r.URL.Query()
 	env["StaticPrefix"] = "/static"
 	return nil
 }
@@ -610,6 +922,22 @@ func (pm *PageManager) FuncMap() map[string]interface{} {
 		"getValueWithID": pm.getValueWithID,
 		"getRows":        pm.getRows,
 		"getRowsWithID":  pm.getRowsWithID,
+		"queryRows":      pm.queryRows,
+		"getString":      pm.getString,
+		"getInt":         pm.getInt,
+		"getBool":        pm.getBool,
+		"getMap":         pm.getMap,
+		"getList":        pm.getList,
+		"hasValue":       pm.hasValue,
+		"isNull":         pm.isNull,
+		"search":         pm.search,
+		"listItems":      pm.listItems,
+		"getItem":        pm.getItem,
+		"mediaURL":       pm.mediaURL,
+		"srcset":         pm.srcset,
+		"fileExists":     pm.fileExists,
+		"imageFallback":  pm.imageFallback,
+		"videoEmbed":     pm.renderVideoEmbed,
 		"notNull":        notNull,
 		"spew": func(a ...interface{}) template.HTML {
 			s := spew.Sdump(a...)
@@ -627,17 +955,22 @@ func (pm *PageManager) getValue(env map[string]interface{}, key string) (interfa
 	return pm.getValueWithID(env, key, id)
 }
 
+// dataColumn returns the pm_templatedata column expression that templates
+// rendered with env should read from. Pages in edit mode see the draft if
+// there is one, everyone else only ever sees published data.
+func dataColumn(env map[string]interface{}) string {
+	if editMode, _ := env["EditMode"].(bool); editMode {
+		return "COALESCE(draft, data)"
+	}
+	return "data"
+}
+
 func (pm *PageManager) getValueWithID(env map[string]interface{}, key, id string) (interface{}, error) {
-	var value sql.NullString
-	query := "SELECT json_extract(data, ?) FROM pm_templatedata WHERE id = ?"
-	err := pm.db.QueryRow(query, "$."+key, id).Scan(&value)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+	value, _, err := pm.loader(env).lookup(id, "$."+key)
+	if err != nil || value == nil {
 		return nil, err
 	}
-	if value.Valid {
-		return value.String, nil
-	}
-	return nil, nil
+	return sqliteText(value)
 }
 
 func notNull(val interface{}) bool {
@@ -663,20 +996,14 @@ func (pm *PageManager) getRows(env map[string]interface{}, key string) ([]interf
 }
 
 func (pm *PageManager) getRowsWithID(env map[string]interface{}, key, id string) ([]interface{}, error) {
-	var s sql.NullString
-	query := "SELECT json_extract(data, ?) FROM pm_templatedata WHERE id = ?"
 	id = strings.TrimSuffix(id, "/edit")
-	err := pm.db.QueryRow(query, "$."+key, id).Scan(&s)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+	value, _, err := pm.loader(env).lookup(id, "$."+key)
+	if err != nil || value == nil {
 		return nil, err
 	}
-	var array []interface{}
-	if s.Valid {
-		err = json.Unmarshal([]byte(s.String), &array)
-		if err != nil {
-			return array, err
-		}
-		return array, nil
+	array, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: %s is a %T, not a list of rows", id, key, value)
 	}
-	return nil, nil
+	return array, nil
 }
@@ -9,6 +9,9 @@ document.addEventListener("DOMContentLoaded", function main() {
   for (const img of document.querySelectorAll("img[data-pm\\.img\\.upload]")) {
     pmImagePicker(img);
   }
+  for (const node of document.querySelectorAll("[data-pm\\.video-embed]")) {
+    pmVideoPicker(node);
+  }
   for (const node of document.querySelectorAll("[data-pm\\.row]")) {
     node.addEventListener("mouseenter", hoverdel(node));
   }
@@ -271,6 +274,8 @@ document.addEventListener("DOMContentLoaded", function main() {
       deleteButton,
       // Save
       pmCreateElement("button", buttonAttributes({ title: "save changes to page", onclick: save }), "Save"),
+      // Publish
+      pmCreateElement("button", buttonAttributes({ title: "publish saved changes", onclick: publish }), "Publish"),
     );
     const toolbarPadding = pmCreateElement("div", { class: "pm-toolbar-padding" });
     document.querySelector("body")?.append(toolbar, toolbarPadding);
@@ -618,6 +623,12 @@ document.addEventListener("DOMContentLoaded", function main() {
       return undefined;
     }
 
+    // versions maps every ID read by the page to the version of its data
+    // that was loaded (or last saved). Saves are rejected if someone else has
+    // changed the data of an ID since then.
+    const versionsScript = document.getElementById("pm-versions");
+    const versions = versionsScript ? JSON.parse(versionsScript.textContent) : {};
+
     async function save() {
       const data = {};
       const indextracker = {};
@@ -654,11 +665,27 @@ document.addEventListener("DOMContentLoaded", function main() {
           set(data, [ID, row.name, row.index, hrefKey], hrefValue);
         }
       }
+      // Only videos that were changed are sent, as the URL that was pasted.
+      // The server works out the provider and video ID from it.
+      for (const node of document.querySelectorAll("[data-pm\\.video-embed]")) {
+        if (node.pmVideoURL === undefined) {
+          continue;
+        }
+        const ID = node.getAttribute("data-pm.id") || pageID;
+        const key = node.getAttribute("data-pm.video-embed");
+        set(data, [ID, key], node.pmVideoURL);
+      }
+      // Images are cropped on the server: send the original (only if it
+      // changed) together with the crop rather than a re-encoded canvas.
       const imgs = [];
-      for (const canvas of document.querySelectorAll("canvas[data-pm\\.img\\.upload]")) {
+      const canvases = document.querySelectorAll("canvas[data-pm\\.img\\.upload]");
+      for (const canvas of canvases) {
         const url = canvas.getAttribute("data-pm.img.upload");
-        const blob = await new Promise((resolve) => canvas.toBlob(resolve));
-        imgs.push({ url, blob });
+        if (!url || !canvas.pmDirty || !canvas.pmDirty()) {
+          continue;
+        }
+        const original = await canvas.pmOriginal();
+        imgs.push({ url, original, crop: canvas.pmCrop(), keepMetadata: canvas.pmKeepMetadata() });
       }
       console.log(data);
       console.log(imgs);
@@ -667,15 +694,83 @@ document.addEventListener("DOMContentLoaded", function main() {
         formdata.append(key, JSON.stringify(value));
       }
       for (const img of imgs) {
-        formdata.append("imgs[]", img.blob, img.url);
+        if (img.original) {
+          formdata.append(img.url, img.original, img.original.name || img.url.split("/").pop());
+        }
+        formdata.append("pm-crop:" + img.url, JSON.stringify(img.crop));
+        if (img.keepMetadata) {
+          formdata.append("pm-keep-metadata:" + img.url, "true");
+        }
       }
       // Display the key/value pairs
       for (const [key, value] of formdata.entries()) {
         console.log(key + ", " + value);
       }
-      const res = await fetch("/upload", {
+      const sendSave = () =>
+        fetch("/pm-save", {
+          method: "POST",
+          headers: { "X-Pm-Versions": JSON.stringify(versions) },
+          body: formdata,
+        });
+      let res = await sendSave();
+      // Overwriting someone else's changes must be confirmed every time: the
+      // save is resent with the versions of their changes, so that it fails
+      // again if the data changed once more in the meantime.
+      while (res.status === 409) {
+        const { conflicts } = await res.json();
+        console.log(conflicts);
+        const IDs = Object.keys(conflicts).join(", ");
+        if (!window.confirm(`${IDs} has been changed by someone else since this page was loaded. Overwrite their changes?`)) {
+          return;
+        }
+        for (const [ID, conflict] of Object.entries(conflicts)) {
+          versions[ID] = conflict.updated_at;
+        }
+        res = await sendSave();
+      }
+      if (res.ok) {
+        const { versions: saved } = await res.json();
+        Object.assign(versions, saved);
+        for (const canvas of canvases) {
+          if (canvas.pmSaved) {
+            canvas.pmSaved();
+          }
+        }
+      } else {
+        await showError(res);
+      }
+      console.log(res);
+    }
+
+    // showError displays the error of a failed request. Rejected uploads
+    // come back as {"error": {"code", "message", "file"}}; anything else is
+    // shown as plain text.
+    async function showError(res) {
+      const text = await res.text();
+      let message = text;
+      try {
+        const { error } = JSON.parse(text);
+        if (error && error.message) {
+          const where = error.file || error.field;
+          message = where ? `${where}: ${error.message}` : error.message;
+        }
+      } catch (e) {}
+      window.alert(`Save failed (${res.status}): ${message}`);
+    }
+
+    async function publish() {
+      const pageID = window.Env("PageID").replace(/\/edit$/, "");
+      const IDs = new Set([pageID]);
+      for (const node of document.querySelectorAll("[data-pm\\.id]")) {
+        IDs.add(node.getAttribute("data-pm.id"));
+      }
+      const params = new URLSearchParams();
+      for (const ID of IDs) {
+        params.append("id", ID);
+      }
+      const res = await fetch("/pm-publish", {
         method: "POST",
-        body: formdata,
+        body: params,
       });
       console.log(res);
     }
@@ -732,6 +827,31 @@ document.addEventListener("DOMContentLoaded", function main() {
     node.classList.add("contenteditable");
   }
 
+  // pmVideoPicker adds a button to an element showing a video embed that
+  // replaces the video with one whose URL is pasted in. The new video is only
+  // shown once the page is saved and reloaded, since the server decides which
+  // URLs can be embedded.
+  function pmVideoPicker(node) {
+    const status = pmCreateElement("span", { class: "pm-video-status" });
+    const button = pmCreateElement(
+      "button",
+      {
+        type: "button",
+        class: "pm-video-button",
+        onclick: function () {
+          const url = window.prompt("Paste the URL of a video (leave empty to remove the video):", node.pmVideoURL || "");
+          if (url === null) {
+            return;
+          }
+          node.pmVideoURL = url.trim();
+          status.textContent = node.pmVideoURL ? `Will show ${node.pmVideoURL} once saved` : "Video will be removed once saved";
+        },
+      },
+      "Change video"
+    );
+    node.after(pmCreateElement("div", { class: "pm-video-picker" }, button, status));
+  }
+
   function pmImagePicker(img) {
     // the image that we render onto the canvas
     let sourceImage = pmCreateElement("img", {
@@ -750,6 +870,12 @@ document.addEventListener("DOMContentLoaded", function main() {
     let lastWidthSliderValue = 0; // track widthSlider values
     let lastHeightSliderValue = 0; // track heightSlider values
     let lastMouseX, lastMouseY; // track mouse coords in the canvas
+    const uploadURL = img.getAttribute("data-pm.img.upload") || "";
+    let baseImage = sourceImage; // sourceImage before it is rotated
+    let rotation = 0; // clockwise rotation of baseImage in degrees
+    let originalFile = null; // the file picked by the user, if any
+    let sendBase = img.src !== "" && new URL(img.src, window.location.href).pathname !== uploadURL; // baseImage is not an upload (e.g. a theme's fallback image), so it must be sent as the original
+    let dirty = false; // whether the image changed since it was last saved
     const canvas = pmCreateElement("canvas", {
       "data-pm.img.upload": img.getAttribute("data-pm.img.upload") || "",
       width: img.width,
@@ -766,6 +892,13 @@ document.addEventListener("DOMContentLoaded", function main() {
       style: { "margin-right": "0.5rem" },
       checked: true,
     });
+    // Location and camera metadata is removed from uploads unless this is
+    // checked.
+    const keepMetadata = pmCreateElement("input", {
+      id: Math.random().toString(36).substring(2),
+      type: "checkbox",
+      style: { "margin-right": "0.5rem" },
+    });
     const scaleMax = 2;
     const sliderMax = 100;
     const sliderMin = 0;
@@ -797,6 +930,15 @@ document.addEventListener("DOMContentLoaded", function main() {
       },
       oninput: uploadimage,
     });
+    const rotateButton = pmCreateElement(
+      "button",
+      {
+        type: "button",
+        style: { position: "absolute", top: "10px", right: "10px" },
+        onclick: rotate,
+      },
+      "Rotate",
+    );
     const resizer = pmCreateElement(
       "div",
       {
@@ -815,6 +957,12 @@ document.addEventListener("DOMContentLoaded", function main() {
         keepAspectRatio,
         pmCreateElement("label", { for: keepAspectRatio.id }, "Lock aspect ratio"),
       ),
+      pmCreateElement(
+        "div",
+        {},
+        keepMetadata,
+        pmCreateElement("label", { for: keepMetadata.id }, "Keep photo metadata (location, camera)"),
+      ),
       pmCreateElement(
         "div",
         { style: { display: "flex", "align-items": "center", "justify-content": "space-between" } },
@@ -841,6 +989,7 @@ document.addEventListener("DOMContentLoaded", function main() {
       },
       canvas,
       imgUpload,
+      rotateButton,
       resizer,
     );
     imgpicker.classList.add("imgpicker");
@@ -852,9 +1001,20 @@ document.addEventListener("DOMContentLoaded", function main() {
       outOfBoundsDragging = false;
     });
 
+    canvas.pmDirty = () => dirty;
+    canvas.pmCrop = cropParams;
+    canvas.pmOriginal = original;
+    canvas.pmKeepMetadata = () => keepMetadata.checked;
+    canvas.pmSaved = function () {
+      dirty = false;
+      originalFile = null;
+      sendBase = false;
+    };
+
     function initialRender() {
       render();
       img.replaceWith(imgpicker);
+      loadOriginal();
     }
 
     function fallbackRender() {
@@ -863,6 +1023,8 @@ document.addEventListener("DOMContentLoaded", function main() {
       fallbackImage.src = fallbackSrc;
       fallbackImage.addEventListener("load", function () {
         sourceImage = fallbackImage;
+        baseImage = fallbackImage;
+        sendBase = true;
         render();
       });
       img.replaceWith(imgpicker);
@@ -899,13 +1061,135 @@ document.addEventListener("DOMContentLoaded", function main() {
       if (file === null || file === undefined) {
         return;
       }
-      sourceImage = await createImageBitmap(file);
+      originalFile = file;
+      baseImage = await createImageBitmap(file);
+      rotation = 0;
+      sourceImage = baseImage;
+      resetView();
+      dirty = true;
+      render();
+    }
+
+    function rotate() {
+      rotation = (rotation + 90) % 360;
+      sourceImage = rotated(baseImage, rotation);
+      resetView();
+      dirty = true;
+      render();
+    }
+
+    function resetView() {
       destX = 0;
       destY = 0;
       scaleX = 1;
       scaleY = 1;
       widthSlider.value = 0;
       heightSlider.value = 0;
+      lastWidthSliderValue = 0;
+      lastHeightSliderValue = 0;
+    }
+
+    function dimensions(image) {
+      return {
+        width: image.naturalWidth || image.width,
+        height: image.naturalHeight || image.height,
+      };
+    }
+
+    // rotated returns image rotated clockwise by degrees (a multiple of 90).
+    function rotated(image, degrees) {
+      if (degrees === 0) {
+        return image;
+      }
+      const { width, height } = dimensions(image);
+      const quarterTurn = degrees === 90 || degrees === 270;
+      const rotatedCanvas = document.createElement("canvas");
+      rotatedCanvas.width = quarterTurn ? height : width;
+      rotatedCanvas.height = quarterTurn ? width : height;
+      const ctx = rotatedCanvas.getContext("2d");
+      ctx.translate(rotatedCanvas.width / 2, rotatedCanvas.height / 2);
+      ctx.rotate((degrees * Math.PI) / 180);
+      ctx.drawImage(image, -width / 2, -height / 2);
+      return rotatedCanvas;
+    }
+
+    function sliderValue(scale) {
+      return Math.min(sliderMax, Math.max(sliderMin, Math.round((scale - 1) / sliderStep)));
+    }
+
+    // cropParams converts the part of sourceImage shown on the canvas into
+    // the crop rectangle (in pixels of the rotated original) that the server
+    // cuts out of the original.
+    function cropParams() {
+      const { width, height } = dimensions(sourceImage);
+      const ratioX = width / (canvas.width * scaleX);
+      const ratioY = height / (canvas.height * scaleY);
+      const dpr = window.devicePixelRatio || 1;
+      return {
+        x: Math.round(-destX * ratioX),
+        y: Math.round(-destY * ratioY),
+        width: Math.max(1, Math.round(canvas.width * ratioX)),
+        height: Math.max(1, Math.round(canvas.height * ratioY)),
+        rotate: rotation,
+        output_width: Math.round(canvas.width * dpr),
+        output_height: Math.round(canvas.height * dpr),
+      };
+    }
+
+    // original returns the file that the server should crop, or null if the
+    // server already has it.
+    async function original() {
+      if (originalFile) {
+        return originalFile;
+      }
+      if (!sendBase) {
+        return null;
+      }
+      const res = await fetch(baseImage.src);
+      const blob = await res.blob();
+      return new File([blob], new URL(baseImage.src, window.location.href).pathname.split("/").pop(), { type: blob.type });
+    }
+
+    // loadOriginal swaps in the original that the uploaded image was cropped
+    // from (if any) and restores its crop, so that re-cropping starts from
+    // the full image instead of the cropped one.
+    async function loadOriginal() {
+      if (!uploadURL || sendBase) {
+        return;
+      }
+      const res = await fetch(`/pm-media?path=${encodeURIComponent(uploadURL)}`);
+      if (!res.ok) {
+        return;
+      }
+      const [media] = await res.json();
+      if (!media || !media.original_id || !media.crop) {
+        return;
+      }
+      const originalRes = await fetch(`/pm-media/${media.original_id}`);
+      if (!originalRes.ok) {
+        return;
+      }
+      const { path } = await originalRes.json();
+      const image = new Image();
+      image.src = `/static/${path}`;
+      await image.decode();
+      if (dirty) {
+        // the image was edited while the original was loading
+        return;
+      }
+      const crop = media.crop;
+      baseImage = image;
+      rotation = crop.rotate;
+      sourceImage = rotated(baseImage, rotation);
+      const { width, height } = dimensions(sourceImage);
+      scaleX = width / crop.width;
+      scaleY = height / crop.height;
+      destX = (-crop.x * canvas.width) / crop.width;
+      destY = (-crop.y * canvas.height) / crop.height;
+      lastWidthSliderValue = sliderValue(scaleX);
+      lastHeightSliderValue = sliderValue(scaleY);
+      widthSlider.value = `${lastWidthSliderValue}`;
+      heightSlider.value = `${lastHeightSliderValue}`;
       render();
     }
 
@@ -931,6 +1215,7 @@ document.addEventListener("DOMContentLoaded", function main() {
         destY -= heightDelta / 2;
         lastHeightSliderValue = heightSliderValue;
       }
+      dirty = true;
       render();
     }
 
@@ -956,6 +1241,7 @@ document.addEventListener("DOMContentLoaded", function main() {
         destX -= widthDelta / 2;
         lastWidthSliderValue = widthSliderValue;
       }
+      dirty = true;
       render();
     }
 
@@ -979,6 +1265,7 @@ document.addEventListener("DOMContentLoaded", function main() {
       destY += deltaY;
       lastMouseX = mouseX;
       lastMouseY = mouseY;
+      dirty = true;
       render();
     }
 
@@ -0,0 +1,26 @@
+package pagemanager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestPageManager returns a PageManager set up on an empty datafolder in
+// a temporary directory (with an empty templates folder).
+func newTestPageManager(t *testing.T) *PageManager {
+	t.Helper()
+	defer func(dir string) { *datafolder = dir }(*datafolder)
+	*datafolder = t.TempDir()
+	err := os.Mkdir(filepath.Join(*datafolder, "templates"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := &PageManager{}
+	err = pm.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pm.db.Close() })
+	return pm
+}
@@ -0,0 +1,272 @@
+package pagemanager
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RowsPage is the result of queryRows: one page of rows together with the
+// pagination metadata needed to render links to the other pages.
+type RowsPage struct {
+	Rows       []interface{}
+	Total      int // number of rows after filtering, offset and limit, across all pages
+	Page       int // current page number, starting from 1
+	PerPage    int // 0 if the rows are not paginated
+	TotalPages int
+	PrevURL    string // empty if there is no previous page
+	NextURL    string // empty if there is no next page
+}
+
+// rowsQuery holds the options accepted by queryRows.
+type rowsQuery struct {
+	id        string
+	sortField string
+	sortDesc  bool
+	filters   map[string]string
+	dateField string
+	from, to  time.Time
+	limit     int
+	offset    int
+	perPage   int
+	pageParam string
+}
+
+// dateLayouts are the date formats understood by queryRows when filtering by
+// a date range or sorting by a date field.
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02",
+	"2006 January 02",
+	"2006 January 2",
+	"2006 Jan 02",
+	"January 2, 2006",
+	"Jan 2, 2006",
+	"2 January 2006",
+	"02 Jan 2006",
+}
+
+func parseDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func parseRowsQuery(args []interface{}) (rowsQuery, error) {
+	query := rowsQuery{filters: make(map[string]string), pageParam: "page"}
+	if len(args)%2 != 0 {
+		return query, fmt.Errorf("queryRows: options must be given as key value pairs")
+	}
+	for i := 0; i < len(args); i += 2 {
+		key, ok := args[i].(string)
+		if !ok {
+			return query, fmt.Errorf("queryRows: option name %v is not a string", args[i])
+		}
+		value := args[i+1]
+		svalue := fmt.Sprint(value)
+		var err error
+		switch {
+		case key == "id":
+			query.id = svalue
+		case key == "sort":
+			query.sortField = strings.TrimPrefix(svalue, "-")
+			query.sortDesc = strings.HasPrefix(svalue, "-")
+		case strings.HasPrefix(key, "filter."):
+			query.filters[strings.TrimPrefix(key, "filter.")] = svalue
+		case key == "dateField":
+			query.dateField = svalue
+		case key == "from" || key == "to":
+			t, ok := parseDate(svalue)
+			if !ok {
+				return query, fmt.Errorf("queryRows: %s %q is not a recognized date", key, svalue)
+			}
+			if key == "from" {
+				query.from = t
+			} else {
+				query.to = t
+			}
+		case key == "limit":
+			query.limit, err = strconv.Atoi(svalue)
+		case key == "offset":
+			query.offset, err = strconv.Atoi(svalue)
+		case key == "perPage":
+			query.perPage, err = strconv.Atoi(svalue)
+		case key == "pageParam":
+			query.pageParam = svalue
+		default:
+			return query, fmt.Errorf("queryRows: unknown option %q", key)
+		}
+		if err != nil {
+			return query, fmt.Errorf("queryRows: %s %q is not a number", key, svalue)
+		}
+	}
+	if (!query.from.IsZero() || !query.to.IsZero()) && query.dateField == "" {
+		return query, fmt.Errorf("queryRows: from/to given without a dateField")
+	}
+	return query, nil
+}
+
+// queryRows returns the rows stored under key, filtered, sorted and
+// paginated according to the options given as key value pairs:
+//
+//	id         read from this pm_templatedata ID instead of the current page
+//	sort       field to sort by, prefix with - to sort in descending order
+//	filter.X   only keep rows whose field X equals the given value
+//	dateField  field holding the date that from and to are compared against
+//	from, to   only keep rows whose dateField lies within [from, to]
+//	limit      maximum number of rows returned
+//	offset     number of rows skipped
+//	perPage    paginate the rows, taking the page number from the URL query
+//	pageParam  name of the URL query parameter holding the page number ("page")
+//
+// e.g. {{ $posts := queryRows .Env "posts" "sort" "-date" "perPage" 10 }}
+func (pm *PageManager) queryRows(env map[string]interface{}, key string, args ...interface{}) (RowsPage, error) {
+	query, err := parseRowsQuery(args)
+	if err != nil {
+		return RowsPage{}, err
+	}
+	id := query.id
+	if id == "" {
+		id, _ = env["PageID"].(string)
+	}
+	rows, err := pm.getRowsWithID(env, key, id)
+	if err != nil {
+		return RowsPage{}, err
+	}
+	return query.apply(env, rows), nil
+}
+
+// apply filters, sorts and paginates rows according to query. The page
+// number is taken from the RequestURL in env.
+func (query rowsQuery) apply(env map[string]interface{}, rows []interface{}) RowsPage {
+	var result RowsPage
+	// filter
+	filtered := rows[:0:0]
+	for _, row := range rows {
+		m, _ := row.(map[string]interface{})
+		if query.matches(m) {
+			filtered = append(filtered, row)
+		}
+	}
+	// sort
+	if query.sortField != "" {
+		sort.SliceStable(filtered, func(i, j int) bool {
+			a, _ := filtered[i].(map[string]interface{})
+			b, _ := filtered[j].(map[string]interface{})
+			if query.sortDesc {
+				return lessValue(b[query.sortField], a[query.sortField])
+			}
+			return lessValue(a[query.sortField], b[query.sortField])
+		})
+	}
+	// limit and offset
+	if query.offset > 0 {
+		if query.offset > len(filtered) {
+			query.offset = len(filtered)
+		}
+		filtered = filtered[query.offset:]
+	}
+	if query.limit > 0 && query.limit < len(filtered) {
+		filtered = filtered[:query.limit]
+	}
+	result.Total = len(filtered)
+	result.Page = 1
+	result.TotalPages = 1
+	if query.perPage <= 0 {
+		result.Rows = filtered
+		return result
+	}
+	// paginate
+	result.PerPage = query.perPage
+	result.TotalPages = (result.Total + query.perPage - 1) / query.perPage
+	if result.TotalPages == 0 {
+		result.TotalPages = 1
+	}
+	rawurl, _ := env["RequestURL"].(string)
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		u = &url.URL{}
+	}
+	values := u.Query()
+	if page, err := strconv.Atoi(values.Get(query.pageParam)); err == nil && page > 0 {
+		result.Page = page
+	}
+	if result.Page > result.TotalPages {
+		result.Page = result.TotalPages
+	}
+	start := (result.Page - 1) * query.perPage
+	if start > result.Total {
+		start = result.Total
+	}
+	end := start + query.perPage
+	if end > result.Total {
+		end = result.Total
+	}
+	result.Rows = filtered[start:end]
+	pageURL := func(page int) string {
+		values.Set(query.pageParam, strconv.Itoa(page))
+		u2 := *u
+		u2.RawQuery = values.Encode()
+		return u2.String()
+	}
+	if result.Page > 1 {
+		result.PrevURL = pageURL(result.Page - 1)
+	}
+	if result.Page < result.TotalPages {
+		result.NextURL = pageURL(result.Page + 1)
+	}
+	return result
+}
+
+func (query rowsQuery) matches(row map[string]interface{}) bool {
+	for field, want := range query.filters {
+		value, ok := row[field]
+		if !ok || fmt.Sprint(value) != want {
+			return false
+		}
+	}
+	if query.dateField == "" || (query.from.IsZero() && query.to.IsZero()) {
+		return true
+	}
+	s, _ := row[query.dateField].(string)
+	t, ok := parseDate(s)
+	if !ok {
+		return false
+	}
+	if !query.from.IsZero() && t.Before(query.from) {
+		return false
+	}
+	if !query.to.IsZero() && t.After(query.to) {
+		return false
+	}
+	return true
+}
+
+// lessValue orders two JSON values: numbers numerically, dates
+// chronologically and everything else as strings. Missing values sort
+// first.
+func lessValue(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b != nil
+	}
+	if x, ok := a.(float64); ok {
+		if y, ok := b.(float64); ok {
+			return x < y
+		}
+	}
+	sa, sb := fmt.Sprint(a), fmt.Sprint(b)
+	if ta, ok := parseDate(sa); ok {
+		if tb, ok := parseDate(sb); ok {
+			return ta.Before(tb)
+		}
+	}
+	return sa < sb
+}
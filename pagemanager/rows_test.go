@@ -0,0 +1,75 @@
+package pagemanager
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRowsQuery(t *testing.T) {
+	tests := []struct {
+		args    []interface{}
+		wantErr bool
+	}{
+		{[]interface{}{"sort", "-date", "perPage", 10}, false},
+		{[]interface{}{"filter.tag", "go", "limit", "3", "offset", 1}, false},
+		{[]interface{}{"dateField", "date", "from", "2021-01-01", "to", "Jan 2, 2021"}, false},
+		{[]interface{}{"sort"}, true},
+		{[]interface{}{1, "x"}, true},
+		{[]interface{}{"limit", "ten"}, true},
+		{[]interface{}{"from", "2021-01-01"}, true},
+		{[]interface{}{"dateField", "date", "from", "yesterday"}, true},
+		{[]interface{}{"order", "date"}, true},
+	}
+	for _, tt := range tests {
+		_, err := parseRowsQuery(tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRowsQuery(%v) error = %v, want error %v", tt.args, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRowsQueryApply(t *testing.T) {
+	rows := []interface{}{
+		map[string]interface{}{"title": "a", "tag": "go", "date": "2021-01-03", "n": 3.0},
+		map[string]interface{}{"title": "b", "tag": "js", "date": "2021-01-01", "n": 10.0},
+		map[string]interface{}{"title": "c", "tag": "go", "date": "2021 January 02", "n": 2.0},
+		map[string]interface{}{"title": "d", "tag": "go", "n": 1.0},
+	}
+	titles := func(page RowsPage) []string {
+		var titles []string
+		for _, row := range page.Rows {
+			titles = append(titles, row.(map[string]interface{})["title"].(string))
+		}
+		return titles
+	}
+	tests := []struct {
+		args       []interface{}
+		requestURL string
+		want       []string
+		prev, next string
+	}{
+		{[]interface{}{"sort", "n"}, "", []string{"d", "c", "a", "b"}, "", ""},
+		{[]interface{}{"sort", "-n"}, "", []string{"b", "a", "c", "d"}, "", ""},
+		{[]interface{}{"sort", "date"}, "", []string{"d", "b", "c", "a"}, "", ""},
+		{[]interface{}{"filter.tag", "go", "sort", "title"}, "", []string{"a", "c", "d"}, "", ""},
+		{[]interface{}{"filter.n", "10"}, "", []string{"b"}, "", ""},
+		{[]interface{}{"dateField", "date", "from", "2021-01-02", "sort", "title"}, "", []string{"a", "c"}, "", ""},
+		{[]interface{}{"sort", "title", "offset", 1, "limit", 2}, "", []string{"b", "c"}, "", ""},
+		{[]interface{}{"sort", "title", "perPage", 3}, "/posts", []string{"a", "b", "c"}, "", "/posts?page=2"},
+		{[]interface{}{"sort", "title", "perPage", 3}, "/posts?page=2", []string{"d"}, "/posts?page=1", ""},
+		{[]interface{}{"sort", "title", "perPage", 3}, "/posts?page=9", []string{"d"}, "/posts?page=1", ""},
+	}
+	for _, tt := range tests {
+		query, err := parseRowsQuery(tt.args)
+		if err != nil {
+			t.Fatalf("parseRowsQuery(%v): %v", tt.args, err)
+		}
+		page := query.apply(map[string]interface{}{"RequestURL": tt.requestURL}, rows)
+		if got := titles(page); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v %s: got %q, want %q", tt.args, tt.requestURL, got, tt.want)
+		}
+		if page.PrevURL != tt.prev || page.NextURL != tt.next {
+			t.Errorf("%v %s: prev, next = %q, %q, want %q, %q", tt.args, tt.requestURL, page.PrevURL, page.NextURL, tt.prev, tt.next)
+		}
+	}
+}
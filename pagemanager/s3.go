@@ -0,0 +1,310 @@
+package pagemanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+)
+
+var (
+	s3Endpoint = flag.String("pm-s3-endpoint", "", "URL of the S3-compatible server, e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000")
+	s3Bucket   = flag.String("pm-s3-bucket", "", "S3 bucket that uploads are stored in")
+	s3Region   = flag.String("pm-s3-region", "us-east-1", "S3 region")
+	s3Prefix   = flag.String("pm-s3-prefix", "", "prefix added to the key of every upload stored in S3")
+)
+
+// S3Storage stores files in a bucket of an S3-compatible server. Requests
+// use path-style URLs ({endpoint}/{bucket}/{key}) so that any server
+// implementing the S3 API, including local stand-ins, can be used.
+type S3Storage struct {
+	Endpoint        string // e.g. https://s3.us-east-1.amazonaws.com
+	Bucket          string
+	Region          string
+	Prefix          string // added to the key of every file
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string // optional
+	Client          *http.Client
+}
+
+// NewS3StorageFromFlags returns the S3Storage configured by the -pm-s3-*
+// flags. Credentials are read from the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+func NewS3StorageFromFlags() (*S3Storage, error) {
+	s := &S3Storage{
+		Endpoint:        strings.TrimSuffix(*s3Endpoint, "/"),
+		Bucket:          *s3Bucket,
+		Region:          *s3Region,
+		Prefix:          *s3Prefix,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Client:          http.DefaultClient,
+	}
+	if s.Endpoint == "" || s.Bucket == "" {
+		return nil, fmt.Errorf("-pm-storage s3 requires -pm-s3-endpoint and -pm-s3-bucket")
+	}
+	if s.AccessKeyID == "" || s.SecretAccessKey == "" {
+		return nil, fmt.Errorf("-pm-storage s3 requires the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables")
+	}
+	return s, nil
+}
+
+// do sends a request for key (or for the bucket if key is empty) signed with
+// AWS Signature Version 4.
+func (s *S3Storage) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	u.Path = "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, body, time.Now().UTC())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// sign adds the AWS Signature Version 4 Authorization header to req, see
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html.
+func (s *S3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	amzdate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzdate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes every byte of s except the unreserved characters
+// A-Z, a-z, 0-9, '-', '_', '.' and '~' (and '/' if keepSlash is set), as
+// required by Signature Version 4.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, true)
+}
+
+// s3CanonicalQuery encodes query sorted by key, which is both a valid query
+// string and the canonical query string of Signature Version 4.
+func s3CanonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// s3Error converts an unsuccessful response into an error, which satisfies
+// errors.Is(err, fs.ErrNotExist) for 404 Not Found.
+func s3Error(op, name string, res *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+	if res.StatusCode == http.StatusNotFound {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("s3: %s: %s", res.Status, bytes.TrimSpace(b))}
+}
+
+func (s *S3Storage) Put(ctx context.Context, name string, r io.Reader) error {
+	if err := checkStorageName("put", name); err != nil {
+		return err
+	}
+	// The payload is buffered because Signature Version 4 signs its hash.
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	res, err := s.do(ctx, http.MethodPut, s.Prefix+name, nil, body)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s3Error("put", name, res)
+	}
+	return nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := checkStorageName("get", name); err != nil {
+		return nil, err
+	}
+	res, err := s.do(ctx, http.MethodGet, s.Prefix+name, nil, nil)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, s3Error("get", name, res)
+	}
+	return res.Body, nil
+}
+
+func (s *S3Storage) Delete(ctx context.Context, name string) error {
+	if err := checkStorageName("delete", name); err != nil {
+		return err
+	}
+	res, err := s.do(ctx, http.MethodDelete, s.Prefix+name, nil, nil)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return s3Error("delete", name, res)
+	}
+	return nil
+}
+
+func (s *S3Storage) Stat(ctx context.Context, name string) (StorageInfo, error) {
+	if err := checkStorageName("stat", name); err != nil {
+		return StorageInfo{}, err
+	}
+	res, err := s.do(ctx, http.MethodHead, s.Prefix+name, nil, nil)
+	if err != nil {
+		return StorageInfo{}, erro.Wrap(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return StorageInfo{}, s3Error("stat", name, res)
+	}
+	info := StorageInfo{Name: name}
+	info.Size, _ = strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	info.ModTime, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+// s3ListResult is the response of ListObjectsV2.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]StorageInfo, error) {
+	var infos []StorageInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix + prefix}}
+	for {
+		res, err := s.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return infos, erro.Wrap(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			err = s3Error("list", prefix, res)
+			res.Body.Close()
+			return infos, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return infos, erro.Wrap(err)
+		}
+		for _, object := range result.Contents {
+			infos = append(infos, StorageInfo{
+				Name:    strings.TrimPrefix(object.Key, s.Prefix),
+				Size:    object.Size,
+				ModTime: object.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
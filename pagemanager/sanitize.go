@@ -0,0 +1,261 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/bokwoon95/erro"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// defaultPolicy is the sanitization policy applied to fields that do not
+// have one set in their template metadata.
+const defaultPolicy = "ugc"
+
+// newPolicies returns the sanitization policies that template metadata may
+// pick from for each field:
+//
+//	text    no HTML at all
+//	inline  inline formatting (bold, italics, links...) but no block elements
+//	ugc     user generated content, including block elements and styling
+//	url     a link href: an http, https or mailto URL or a relative URL
+//	none    no sanitization, for values that are neither HTML nor hrefs
+//	video   a video URL of one of the -pm-video-providers, stored as a VideoEmbed
+func newPolicies(ugc *bluemonday.Policy) map[string]*bluemonday.Policy {
+	inline := bluemonday.NewPolicy()
+	inline.AllowStandardURLs()
+	inline.AllowAttrs("href").OnElements("a")
+	inline.AllowElements("a", "abbr", "b", "br", "cite", "code", "del", "em", "i", "ins", "kbd", "mark", "q", "s", "small", "span", "strong", "sub", "sup", "u")
+	return map[string]*bluemonday.Policy{
+		"text":   bluemonday.StrictPolicy(),
+		"inline": inline,
+		"ugc":    ugc,
+		"url":    nil, // handled by sanitizeURL
+		"none":   nil,
+		"video":  nil, // handled by sanitizeVideo
+	}
+}
+
+// sanitizePolicies returns the field policies that apply to the data of id,
+// keyed by field path (e.g. "posts.summary"). A "*" key sets the policy for
+// fields that are not listed. The policies come from the metadata of the
+// template of the route id, or from the declared types of the theme settings
+// stored under id.
+func (pm *PageManager) sanitizePolicies(id string) (map[string]string, error) {
+	route, err := pm.getroute(id)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	if route.Template.Valid {
+		return pm.templatePolicies(route.Template.String)
+	}
+	list, err := ListThemeSettings(pm.fsys)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	for _, settings := range list {
+		if settings.ID != id {
+			continue
+		}
+		policies := make(map[string]string)
+		for _, field := range settings.Fields {
+			switch field.Type {
+			case "html":
+				policies[field.Name] = "ugc"
+			case "url":
+				policies[field.Name] = "url"
+			default:
+				policies[field.Name] = "text"
+			}
+		}
+		return policies, nil
+	}
+	return nil, nil
+}
+
+// templatePolicies returns the field policies declared in the metadata of
+// template. Fields that the template files embed with data-pm.video-embed get
+// the "video" policy unless the metadata declares another one.
+func (pm *PageManager) templatePolicies(template string) (map[string]string, error) {
+	metadata, err := GetTemplateMetadata(pm.fsys, template)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	fields, err := videoEmbedFields(pm.fsys, append([]string{metadata.Name, metadata.MainTemplate}, metadata.Include...))
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	policies := make(map[string]string, len(metadata.Sanitize)+len(fields))
+	for field, policy := range metadata.Sanitize {
+		policies[field] = policy
+	}
+	for _, field := range fields {
+		if _, ok := policies[field]; !ok {
+			policies[field] = "video"
+		}
+	}
+	return policies, nil
+}
+
+// sanitizeTemplateData sanitizes every string value in the JSON data of id
+// according to the policy of its field.
+func (pm *PageManager) sanitizeTemplateData(id string, data string) (string, error) {
+	if strings.TrimSpace(data) == "" {
+		return data, nil
+	}
+	policies, err := pm.sanitizePolicies(id)
+	if err != nil {
+		return data, erro.Wrap(err)
+	}
+	var value interface{}
+	err = json.Unmarshal([]byte(data), &value)
+	if err != nil {
+		return data, erro.Wrap(err)
+	}
+	value, err = pm.sanitizeValue(value, "", policies)
+	if err != nil {
+		return data, erro.Wrap(err)
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return data, erro.Wrap(err)
+	}
+	return string(b), nil
+}
+
+func (pm *PageManager) sanitizeValue(value interface{}, path string, policies map[string]string) (interface{}, error) {
+	if policies[path] == "video" {
+		return pm.sanitizeVideo(value, path)
+	}
+	var err error
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, v := range value {
+			childpath := key
+			if path != "" {
+				childpath = path + "." + key
+			}
+			value[key], err = pm.sanitizeValue(v, childpath, policies)
+			if err != nil {
+				return value, err
+			}
+		}
+		return value, nil
+	case []interface{}:
+		for i, v := range value {
+			value[i], err = pm.sanitizeValue(v, path, policies)
+			if err != nil {
+				return value, err
+			}
+		}
+		return value, nil
+	case string:
+		name, ok := policies[path]
+		if !ok {
+			name, ok = policies["*"]
+		}
+		if !ok {
+			name = defaultPolicy
+		}
+		policy, ok := pm.policies[name]
+		if !ok {
+			return value, fmt.Errorf("%s: unknown sanitize policy %q", path, name)
+		}
+		if name == "url" {
+			return sanitizeURL(value), nil
+		}
+		// Strings without any tags cannot carry markup, so they are left
+		// untouched instead of having their &, ' and " characters escaped.
+		if policy == nil || !strings.Contains(value, "<") {
+			return value, nil
+		}
+		return policy.Sanitize(value), nil
+	default:
+		return value, nil
+	}
+}
+
+// sanitizeURL returns the trimmed href s if it is an http, https or mailto URL
+// or a relative URL, and an empty string otherwise. This keeps javascript:,
+// data: and other scriptable URLs out of link fields.
+func sanitizeURL(s string) string {
+	s = strings.TrimSpace(s)
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	switch u.Scheme {
+	case "", "http", "https", "mailto":
+		return s
+	default:
+		return ""
+	}
+}
+
+// Resanitize runs every row of pm_templatedata through the current
+// sanitization policies, rewriting (and recording a revision for) the
+// published data and drafts that change. It returns the IDs that changed.
+func (pm *PageManager) Resanitize(ctx context.Context) ([]string, error) {
+	type row struct {
+		id          string
+		data, draft sql.NullString
+	}
+	var rows []row
+	result, err := pm.db.QueryContext(ctx, "SELECT id, data, draft FROM pm_templatedata ORDER BY id")
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	defer result.Close()
+	for result.Next() {
+		var r row
+		err = result.Scan(&r.id, &r.data, &r.draft)
+		if err != nil {
+			return nil, erro.Wrap(err)
+		}
+		rows = append(rows, r)
+	}
+	err = result.Err()
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	var changed []string
+	for _, r := range rows {
+		var data, draft string
+		if r.data.Valid {
+			data, err = pm.sanitizeTemplateData(r.id, r.data.String)
+			if err != nil {
+				return changed, erro.Wrap(err)
+			}
+		}
+		if r.draft.Valid {
+			draft, err = pm.sanitizeTemplateData(r.id, r.draft.String)
+			if err != nil {
+				return changed, erro.Wrap(err)
+			}
+		}
+		dataChanged := r.data.Valid && data != r.data.String
+		draftChanged := r.draft.Valid && draft != r.draft.String
+		if !dataChanged && !draftChanged {
+			continue
+		}
+		changed = append(changed, r.id)
+		err = pm.withTx(ctx, func(tx *sql.Tx) error {
+			if !dataChanged {
+				return pm.saveTemplateData(ctx, tx, r.id, draft)
+			}
+			err := pm.replaceTemplateData(ctx, tx, r.id, data, sql.NullString{String: draft, Valid: r.draft.Valid})
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			return audit(ctx, tx, AuditSanitize, "pm_templatedata:"+r.id, contentHash([]byte(r.data.String), true), contentHash([]byte(data), true))
+		})
+		if err != nil {
+			return changed, erro.Wrap(err)
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,61 @@
+package pagemanager
+
+import "testing"
+
+func TestSanitizeURL(t *testing.T) {
+	tests := []struct {
+		href, want string
+	}{
+		{"https://example.com/a?b=c#d", "https://example.com/a?b=c#d"},
+		{"http://example.com", "http://example.com"},
+		{"HTTPS://EXAMPLE.COM", "HTTPS://EXAMPLE.COM"},
+		{"mailto:someone@example.com", "mailto:someone@example.com"},
+		{"/about", "/about"},
+		{"../posts/1", "../posts/1"},
+		{"#top", "#top"},
+		{"//example.com/a", "//example.com/a"},
+		{"  /padded  ", "/padded"},
+		{"", ""},
+		{"javascript:alert(1)", ""},
+		{"JavaScript:alert(1)", ""},
+		{" javascript:alert(1)", ""},
+		{"java\tscript:alert(1)", ""},
+		{"data:text/html,<script>alert(1)</script>", ""},
+		{"vbscript:msgbox(1)", ""},
+		{"ftp://example.com/file", ""},
+	}
+	for _, tt := range tests {
+		if got := sanitizeURL(tt.href); got != tt.want {
+			t.Errorf("sanitizeURL(%q) = %q, want %q", tt.href, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeValuePolicies(t *testing.T) {
+	pm := &PageManager{policies: newPolicies(nil)}
+	value := map[string]interface{}{
+		"nav": []interface{}{
+			map[string]interface{}{"title": "Home", "link": "javascript:alert(1)"},
+			map[string]interface{}{"title": "About", "link": "/about"},
+		},
+		"raw": "javascript:alert(1)",
+	}
+	policies := map[string]string{"nav.link": "url", "nav.title": "text", "raw": "none"}
+	got, err := pm.sanitizeValue(value, "", policies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nav := got.(map[string]interface{})["nav"].([]interface{})
+	if link := nav[0].(map[string]interface{})["link"]; link != "" {
+		t.Errorf("nav[0].link = %q, want it emptied", link)
+	}
+	if link := nav[1].(map[string]interface{})["link"]; link != "/about" {
+		t.Errorf("nav[1].link = %q, want /about", link)
+	}
+	if raw := got.(map[string]interface{})["raw"]; raw != "javascript:alert(1)" {
+		t.Errorf("raw = %q, want it left alone by the none policy", raw)
+	}
+	if _, err := pm.sanitizeValue("x", "title", map[string]string{"title": "bogus"}); err == nil {
+		t.Error("unknown policy was not rejected")
+	}
+}
@@ -0,0 +1,350 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bokwoon95/erro"
+)
+
+// uploadsDir is the folder in the datafolder that uploaded files are stored
+// in. It is served under /static/pm-uploads/.
+const uploadsDir = "pm-uploads"
+
+// conflictError is returned from the save transaction when the data of some
+// IDs was changed by someone else after the editor loaded it.
+type conflictError struct {
+	conflicts map[string]conflict
+}
+
+// conflict is the current server value of an ID that failed to save.
+// UpdatedAt is its current version (see dataVersion), which the editor sends
+// back to overwrite it.
+type conflict struct {
+	Data      json.RawMessage `json:"data"`
+	UpdatedAt string          `json:"updated_at"`
+}
+
+func (e *conflictError) Error() string {
+	ids := make([]string, 0, len(e.conflicts))
+	for id := range e.conflicts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return "changed since it was loaded: " + strings.Join(ids, ", ")
+}
+
+// mergePatch applies patch to target following the JSON merge patch
+// semantics of RFC 7396: objects are merged key by key, null deletes a key
+// and every other value (including arrays) replaces the target value.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = mergePatch(targetObject[key], value)
+	}
+	return targetObject
+}
+
+// serveSave saves the page data built by pagemanager.js. The request body is
+// either a JSON object mapping each pm_templatedata ID to its data, or a
+// multipart form where each value is named after an ID and holds that ID's
+// data as JSON. Each ID's data is merge-patched into its current draft, all
+// within a single transaction.
+//
+// Files in the multipart form are named after the /static/pm-uploads/... URL
+// they are to be saved as. If the form also has a "pm-crop:{URL}" value
+// holding CropParams, the file is the original that the image is cropped
+// from instead; a crop without a file re-crops the image's existing original
+// (see CropUpload). Metadata is stripped from uploads unless the form has a
+// "pm-keep-metadata:{URL}" value set to true. Every upload is validated
+// before anything is saved, and uploads are recorded in the same transaction
+// as the data, their files being written only once everything else succeeded
+// (see storeUploads): a save either succeeds as a whole or changes nothing.
+//
+// The X-Pm-Versions header holds a JSON object mapping IDs to the version
+// (see dataVersion) of their data that the editor loaded, as rendered into
+// the #pm-versions script of the edited page. If the current version of any
+// of those IDs differs, nothing is saved: the whole save fails with 409
+// Conflict, and the response holds the current data and version of every
+// conflicting ID so that the editor can show it. IDs missing from the header
+// are not checked. A successful save responds with the new versions of the
+// saved IDs.
+func (pm *PageManager) serveSave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	versions := make(map[string]string)
+	if s := r.Header.Get("X-Pm-Versions"); s != "" {
+		err := json.Unmarshal([]byte(s), &versions)
+		if err != nil {
+			http.Error(w, "invalid X-Pm-Versions: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ctx := requestContext(r)
+	patches := make(map[string]interface{})
+	batch := &uploadBatch{}
+	limitUploadRequest(w, r)
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediatype {
+	case "application/json":
+		err := json.NewDecoder(r.Body).Decode(&patches)
+		if uerr := requestTooLarge(r, err); uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "multipart/form-data":
+		err := r.ParseMultipartForm(32 << 20)
+		if uerr := requestTooLarge(r, err); uerr != nil {
+			writeUploadError(w, uerr)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for name, headers := range r.MultipartForm.File {
+			for _, header := range headers {
+				if uerr := checkUploadSize(name, header.Size); uerr != nil {
+					writeUploadError(w, uerr)
+					return
+				}
+			}
+		}
+		crops := make(map[string]CropParams)
+		keepMetadata := make(map[string]bool)
+		for id, values := range r.MultipartForm.Value {
+			if len(values) == 0 {
+				continue
+			}
+			if strings.HasPrefix(id, keepMetadataFieldPrefix) {
+				keepMetadata[strings.TrimPrefix(id, keepMetadataFieldPrefix)] = values[len(values)-1] == "true"
+				continue
+			}
+			if strings.HasPrefix(id, cropFieldPrefix) {
+				var crop CropParams
+				err = json.Unmarshal([]byte(values[len(values)-1]), &crop)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("%s: %s", id, err), http.StatusBadRequest)
+					return
+				}
+				crops[strings.TrimPrefix(id, cropFieldPrefix)] = crop
+				continue
+			}
+			var patch interface{}
+			err = json.Unmarshal([]byte(values[len(values)-1]), &patch)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s: %s", id, err), http.StatusBadRequest)
+				return
+			}
+			patches[id] = patch
+		}
+		for name, headers := range r.MultipartForm.File {
+			for _, header := range headers {
+				f, err := header.Open()
+				if err != nil {
+					http.Error(w, erro.Sdump(err), http.StatusBadRequest)
+					return
+				}
+				if crop, ok := crops[name]; ok {
+					delete(crops, name)
+					_, err = pm.stageCrop(ctx, batch, name, header.Filename, f, crop, keepMetadata[name])
+				} else {
+					err = pm.stageUpload(ctx, batch, name, f, keepMetadata[name])
+				}
+				f.Close()
+				if uerr, ok := err.(*UploadError); ok {
+					writeUploadError(w, uerr)
+					return
+				}
+				if err != nil {
+					http.Error(w, erro.Sdump(err), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		for name, crop := range crops {
+			_, err = pm.stageCrop(ctx, batch, name, "", nil, crop, keepMetadata[name])
+			if uerr, ok := err.(*UploadError); ok {
+				writeUploadError(w, uerr)
+				return
+			}
+			if err != nil {
+				http.Error(w, erro.Sdump(err), http.StatusBadRequest)
+				return
+			}
+		}
+	default:
+		http.Error(w, "unsupported Content-Type "+mediatype, http.StatusUnsupportedMediaType)
+		return
+	}
+	ids := make([]string, 0, len(patches))
+	for id := range patches {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	// The data is sanitized again when it is saved, but video fields are
+	// checked up front so that the editor is told which URL was rejected.
+	for _, id := range ids {
+		policies, err := pm.sanitizePolicies(id)
+		if err != nil {
+			http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+			return
+		}
+		_, err = pm.sanitizeValue(patches[id], "", policies)
+		if verr, ok := err.(*VideoError); ok {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]interface{}{"error": verr})
+			return
+		}
+	}
+	saved := make(map[string]string)
+	conflicts := make(map[string]conflict)
+	err := pm.storeUploads(ctx, batch, func(tx *sql.Tx) error {
+		for _, id := range ids {
+			var current sql.NullString
+			var updatedAt sql.NullTime
+			err := tx.QueryRowContext(ctx, "SELECT COALESCE(draft, data), updated_at FROM pm_templatedata WHERE id = ?", id).Scan(&current, &updatedAt)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return erro.Wrap(err)
+			}
+			if version, ok := versions[id]; ok && version != dataVersion(updatedAt) {
+				c := conflict{Data: json.RawMessage("null"), UpdatedAt: dataVersion(updatedAt)}
+				if current.Valid && current.String != "" {
+					c.Data = json.RawMessage(current.String)
+				}
+				conflicts[id] = c
+				continue
+			}
+			var target interface{}
+			if current.Valid && current.String != "" {
+				err = json.Unmarshal([]byte(current.String), &target)
+				if err != nil {
+					return erro.Wrap(err)
+				}
+			}
+			b, err := json.Marshal(mergePatch(target, patches[id]))
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			err = pm.saveTemplateData(ctx, tx, id, string(b))
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			err = tx.QueryRowContext(ctx, "SELECT updated_at FROM pm_templatedata WHERE id = ?", id).Scan(&updatedAt)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+			saved[id] = dataVersion(updatedAt)
+		}
+		if len(conflicts) > 0 {
+			return &conflictError{conflicts: conflicts}
+		}
+		return nil
+	})
+	if len(conflicts) > 0 {
+		writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"error":     (&conflictError{conflicts: conflicts}).Error(),
+			"conflicts": conflicts,
+		})
+		return
+	}
+	if err != nil {
+		http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+		return
+	}
+	// The new versions replace the ones the editor loaded, so that its next
+	// save does not conflict with this one.
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"saved":    ids,
+		"versions": saved,
+	})
+}
+
+// uploadPath converts a /static/pm-uploads/... URL into the corresponding
+// slash-separated path relative to the datafolder. It fails for URLs that
+// point outside the uploads folder.
+func uploadPath(rawurl string) (string, error) {
+	const prefix = "/static/" + uploadsDir + "/"
+	if !strings.HasPrefix(rawurl, prefix) {
+		return "", fmt.Errorf("upload URL %q does not start with %s", rawurl, prefix)
+	}
+	name := path.Clean(strings.TrimPrefix(rawurl, "/static/"))
+	if !strings.HasPrefix(name, uploadsDir+"/") {
+		return "", fmt.Errorf("upload URL %q points outside of %s", rawurl, prefix)
+	}
+	return name, nil
+}
+
+// checkUploadName returns an UploadError if the upload path name (of the
+// upload URL rawurl) is not normalized. Upload URLs are referenced as-is by
+// templates, so they are rejected rather than renamed.
+func checkUploadName(rawurl, name string) *UploadError {
+	for _, segment := range strings.Split(strings.TrimPrefix(name, uploadsDir+"/"), "/") {
+		if normalized := normalizeFilename(segment); normalized != segment {
+			return &UploadError{
+				Status:  http.StatusUnprocessableEntity,
+				Code:    "invalid_filename",
+				Message: fmt.Sprintf("%q is not a valid file or folder name, use %q instead", segment, normalized),
+				File:    rawurl,
+			}
+		}
+	}
+	return nil
+}
+
+// stageUpload validates and prepares src to be written to the location
+// named by the upload URL rawurl and recorded in the media library, adding
+// it to batch. Metadata is stripped from the file unless keepMetadata is set.
+// If the upload breaks the upload rules, the returned error is an
+// *UploadError.
+func (pm *PageManager) stageUpload(ctx context.Context, batch *uploadBatch, rawurl string, src io.Reader, keepMetadata bool) error {
+	name, err := uploadPath(rawurl)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if uerr := checkUploadName(rawurl, name); uerr != nil {
+		return uerr
+	}
+	b, err := io.ReadAll(io.LimitReader(src, *uploadMaxFileSize+1))
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if uerr := validateUpload(rawurl, b); uerr != nil {
+		return uerr
+	}
+	b, stripped, uerr := prepareUpload(rawurl, b, keepMetadata)
+	if uerr != nil {
+		return uerr
+	}
+	_, err = pm.stage(ctx, batch, name, path.Base(name), b, uploadOptions{metadataStripped: stripped})
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package pagemanager
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	// Test cases from RFC 7396, appendix A.
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		{`null`, `{"a":"b"}`, `{"a":"b"}`},
+	}
+	for _, tt := range tests {
+		var target, patch, want interface{}
+		mustUnmarshal(t, tt.target, &target)
+		mustUnmarshal(t, tt.patch, &patch)
+		mustUnmarshal(t, tt.want, &want)
+		got := mergePatch(target, patch)
+		if !reflect.DeepEqual(got, want) {
+			b, _ := json.Marshal(got)
+			t.Errorf("mergePatch(%s, %s) = %s, want %s", tt.target, tt.patch, b, tt.want)
+		}
+	}
+}
+
+func mustUnmarshal(t *testing.T, s string, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(s), v); err != nil {
+		t.Fatalf("unmarshal %s: %v", s, err)
+	}
+}
+
+func TestUploadPath(t *testing.T) {
+	tests := []struct {
+		rawurl  string
+		want    string
+		wantErr bool
+	}{
+		{"/static/pm-uploads/hero.jpg", "pm-uploads/hero.jpg", false},
+		{"/static/pm-uploads/posts/hero.jpg", "pm-uploads/posts/hero.jpg", false},
+		{"/static/pm-uploads/./a//b.png", "pm-uploads/a/b.png", false},
+		{"/static/pm-uploads/../database.sqlite3", "", true},
+		{"/static/pm-uploads/a/../../templates/x.html", "", true},
+		{"/static/templates/hero.jpg", "", true},
+		{"pm-uploads/hero.jpg", "", true},
+		{"/static/pm-uploads", "", true},
+	}
+	for _, tt := range tests {
+		got, err := uploadPath(tt.rawurl)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("uploadPath(%q) = %q, %v, want %q (error: %v)", tt.rawurl, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckUploadName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"pm-uploads/hero.jpg", true},
+		{"pm-uploads/posts/my-hero_2.png", true},
+		{"pm-uploads/Hero.jpg", false},
+		{"pm-uploads/my hero.jpg", false},
+		{"pm-uploads/Posts/hero.jpg", false},
+		{"pm-uploads/hero.JPG", false},
+	}
+	for _, tt := range tests {
+		uerr := checkUploadName("/static/"+tt.name, tt.name)
+		if (uerr == nil) != tt.ok {
+			t.Errorf("checkUploadName(%q) = %v, want ok %v", tt.name, uerr, tt.ok)
+		}
+		if uerr != nil && uerr.Code != "invalid_filename" {
+			t.Errorf("checkUploadName(%q) code = %q, want invalid_filename", tt.name, uerr.Code)
+		}
+	}
+}
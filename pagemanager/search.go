@@ -0,0 +1,339 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bokwoon95/erro"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+var searchEnabled = flag.Bool("pm-search", true, "enable full-text search, which needs go-sqlite3 built with FTS5 (go build -tags sqlite_fts5)")
+
+// pm_search is the full-text index over every page's published data and
+// route content. It is not in the tables slice because it is an FTS5 virtual
+// table: go-sqlite3 only ships with FTS5 when built with the sqlite_fts5 tag,
+// so it is only created if -pm-search is set.
+const searchDDL = "CREATE VIRTUAL TABLE IF NOT EXISTS pm_search USING fts5(url UNINDEXED, body, tokenize = 'porter unicode61')"
+
+// searchIndexVersion is recorded in pm_search_version whenever the search
+// index is rebuilt. Bump it whenever what indexPage and indexItem put in the
+// index changes, so that existing indexes are rebuilt on the next startup.
+const searchIndexVersion = 1
+
+// errSearchDisabled is the searchErr of a PageManager started with
+// -pm-search=false.
+var errSearchDisabled = errors.New("search is disabled by -pm-search=false")
+
+// setupSearch creates the search index, building it if it did not exist yet
+// or was built by a different searchIndexVersion. If SQLite has no FTS5 (as
+// in a plain `go build`), it logs a warning and leaves search unavailable
+// rather than keeping the site from starting.
+func (pm *PageManager) setupSearch(ctx context.Context) error {
+	if !*searchEnabled {
+		pm.searchErr = errSearchDisabled
+		return nil
+	}
+	var exists bool
+	err := pm.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE name = 'pm_search')").Scan(&exists)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	_, err = pm.db.ExecContext(ctx, searchDDL)
+	if err != nil {
+		pm.searchErr = fmt.Errorf("creating the search index: %w (full-text search needs go-sqlite3 built with FTS5: build with `go build -tags sqlite_fts5`, or run with -pm-search=false to turn it off)", err)
+		log.Printf("warning: search is unavailable: %v\n", pm.searchErr)
+		return nil
+	}
+	_, err = pm.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS pm_search_version (version INT NOT NULL)")
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	var version sql.NullInt64
+	err = pm.db.QueryRowContext(ctx, "SELECT MAX(version) FROM pm_search_version").Scan(&version)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if exists && version.Valid && version.Int64 == searchIndexVersion {
+		return nil
+	}
+	return pm.RebuildSearchIndex(ctx)
+}
+
+// Markers that snippet() places around matches. They are swapped for <mark>
+// tags only after the snippet has been HTML escaped.
+const (
+	matchStart = "\x02"
+	matchEnd   = "\x03"
+)
+
+// SearchResult is a single page matching a search query.
+type SearchResult struct {
+	URL     string        `json:"url"`
+	Snippet template.HTML `json:"snippet"` // matching text, matches wrapped in <mark>
+	Rank    float64       `json:"rank"`    // lower is better
+}
+
+// RebuildSearchIndex rebuilds the search index from scratch, picking up any
+// route, page data or collection item that was changed directly in the
+// database.
+func (pm *PageManager) RebuildSearchIndex(ctx context.Context) error {
+	if pm.searchErr != nil {
+		return pm.searchErr
+	}
+	var urls []string
+	rows, err := pm.db.QueryContext(ctx, "SELECT url FROM pm_routes")
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var url string
+		err = rows.Scan(&url)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		urls = append(urls, url)
+	}
+	err = rows.Err()
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	collections, err := pm.ListCollections()
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	slugs := make([][]string, len(collections))
+	for i, c := range collections {
+		items, err := pm.ListItems(c.Name)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for _, item := range items {
+			slugs[i] = append(slugs[i], item.Slug)
+		}
+	}
+	return pm.withTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM pm_search")
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM pm_search_version")
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO pm_search_version (version) VALUES (?)", searchIndexVersion)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		for _, url := range urls {
+			err = pm.indexPage(ctx, tx, url)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		for i, c := range collections {
+			for _, slug := range slugs[i] {
+				err = pm.indexItem(ctx, tx, c, slug)
+				if err != nil {
+					return erro.Wrap(err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// indexPage replaces the search index entry of the route url with its
+// current route content and published page data. Disabled routes, redirects
+// and routes served by other handlers are left out of the index. It does
+// nothing if search is unavailable.
+func (pm *PageManager) indexPage(ctx context.Context, tx *sql.Tx, url string) error {
+	if pm.searchErr != nil {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "DELETE FROM pm_search WHERE url = ?", url)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	var content, data sql.NullString
+	query := `SELECT r.content, t.data
+		FROM pm_routes AS r LEFT JOIN pm_templatedata AS t ON t.id = r.url
+		WHERE r.url = ?
+			AND NOT COALESCE(r.disabled, FALSE)
+			AND r.redirect_url IS NULL
+			AND r.handler_url IS NULL`
+	err = tx.QueryRowContext(ctx, query, url).Scan(&content, &data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	var texts []string
+	if content.Valid {
+		texts = append(texts, stripHTML(content.String))
+	}
+	if data.Valid && strings.TrimSpace(data.String) != "" {
+		var value interface{}
+		err = json.Unmarshal([]byte(data.String), &value)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+		texts = appendText(texts, value)
+	}
+	return insertSearchText(ctx, tx, url, texts)
+}
+
+// insertSearchText adds texts to the search index as the content of url.
+func insertSearchText(ctx context.Context, tx *sql.Tx, url string, texts []string) error {
+	body := strings.TrimSpace(strings.Join(texts, "\n"))
+	if body == "" {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, "INSERT INTO pm_search (url, body) VALUES (?, ?)", url, body)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// appendText appends the HTML-stripped text of every string in the JSON
+// value to texts.
+func appendText(texts []string, value interface{}) []string {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for _, v := range value {
+			texts = appendText(texts, v)
+		}
+	case []interface{}:
+		for _, v := range value {
+			texts = appendText(texts, v)
+		}
+	case string:
+		if text := stripHTML(value); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return texts
+}
+
+var stripPolicy = bluemonday.StrictPolicy()
+
+// stripHTML returns the plain text of s. Tags are replaced with spaces so
+// that the text of adjacent block elements does not run together.
+func stripHTML(s string) string {
+	if !strings.Contains(s, "<") {
+		return strings.TrimSpace(s)
+	}
+	s = strings.ReplaceAll(s, "<", " <")
+	return strings.Join(strings.Fields(html.UnescapeString(stripPolicy.Sanitize(s))), " ")
+}
+
+// matchQuery turns what a visitor typed into an FTS5 query that matches pages
+// containing every word, treating the last word as a prefix so that results
+// show up while the visitor is still typing. Words are quoted so that FTS5
+// operators and syntax errors cannot be injected.
+func matchQuery(q string) string {
+	words := strings.Fields(q)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	if len(words) > 0 {
+		words[len(words)-1] += "*"
+	}
+	return strings.Join(words, " ")
+}
+
+// Search returns up to limit pages matching q, best matches first.
+func (pm *PageManager) Search(ctx context.Context, q string, limit int) ([]SearchResult, error) {
+	if pm.searchErr != nil {
+		return nil, fmt.Errorf("search is unavailable: %w", pm.searchErr)
+	}
+	match := matchQuery(q)
+	if match == "" {
+		return nil, nil
+	}
+	if limit <= 0 {
+		limit = 10
+	}
+	query := "SELECT url, snippet(pm_search, 1, ?, ?, '…', 16), rank FROM pm_search WHERE pm_search MATCH ? ORDER BY rank LIMIT ?"
+	rows, err := pm.db.QueryContext(ctx, query, matchStart, matchEnd, match, limit)
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	defer rows.Close()
+	var results []SearchResult
+	for rows.Next() {
+		var result SearchResult
+		var snippet string
+		err = rows.Scan(&result.URL, &snippet, &result.Rank)
+		if err != nil {
+			return results, erro.Wrap(err)
+		}
+		snippet = html.EscapeString(snippet)
+		snippet = strings.NewReplacer(matchStart, "<mark>", matchEnd, "</mark>").Replace(snippet)
+		result.Snippet = template.HTML(snippet)
+		results = append(results, result)
+	}
+	err = rows.Err()
+	if err != nil {
+		return results, erro.Wrap(err)
+	}
+	return results, nil
+}
+
+// search is the template function for Search, e.g.
+//
+//	{{ range $result := search .Env (.Env.Query.Get "q") 20 }}
+//
+// limit is optional and defaults to 10.
+func (pm *PageManager) search(env map[string]interface{}, q string, limit ...int) ([]SearchResult, error) {
+	n := 0
+	if len(limit) > 0 {
+		n = limit[0]
+	}
+	return pm.Search(context.Background(), q, n)
+}
+
+// serveSearch serves the search results for the q query parameter as JSON.
+// The optional limit query parameter caps the number of results.
+func (pm *PageManager) serveSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var limit int
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "invalid limit: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if pm.searchErr != nil {
+		http.Error(w, "search is unavailable", http.StatusNotImplemented)
+		return
+	}
+	results, err := pm.Search(r.Context(), r.FormValue("q"), limit)
+	if err != nil {
+		http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+		return
+	}
+	if results == nil {
+		results = []SearchResult{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
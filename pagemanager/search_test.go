@@ -0,0 +1,19 @@
+package pagemanager
+
+import (
+	"testing"
+)
+
+// TestSetupSearch checks that a PageManager starts whether or not SQLite was
+// built with FTS5, and that search is only unavailable without it.
+func TestSetupSearch(t *testing.T) {
+	pm := newTestPageManager(t)
+	_, err := pm.db.Exec("CREATE VIRTUAL TABLE fts5_probe USING fts5(x)")
+	hasFTS5 := err == nil
+	if hasFTS5 && pm.searchErr != nil {
+		t.Errorf("SQLite has FTS5 but search is unavailable: %v", pm.searchErr)
+	}
+	if !hasFTS5 && pm.searchErr == nil {
+		t.Error("SQLite has no FTS5 but search is available")
+	}
+}
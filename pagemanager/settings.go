@@ -0,0 +1,329 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bokwoon95/erro"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pelletier/go-toml"
+)
+
+// ThemeSettings are the site-wide values declared by a theme under the
+// [settings] table of its templates-config. The values are stored in
+// pm_templatedata under ID, which the theme's templates read back with
+// getValueWithID.
+type ThemeSettings struct {
+	Theme  string          `toml:"-" mapstructure:"-"`
+	ID     string          `toml:"id" mapstructure:"id"`
+	Fields []SettingsField `toml:"fields" mapstructure:"fields"`
+}
+
+// SettingsField is a single value declared in ThemeSettings.
+type SettingsField struct {
+	Name        string      `toml:"name" mapstructure:"name"`
+	Label       string      `toml:"label" mapstructure:"label"`
+	Type        string      `toml:"type" mapstructure:"type"`
+	Description string      `toml:"description" mapstructure:"description"`
+	Required    bool        `toml:"required" mapstructure:"required"`
+	Default     interface{} `toml:"default" mapstructure:"default"`
+}
+
+var settingsTypes = map[string]struct{}{
+	"string": {},
+	"text":   {},
+	"html":   {},
+	"url":    {},
+	"int":    {},
+	"float":  {},
+	"bool":   {},
+}
+
+// GetThemeSettings reads the settings declared by the theme in the folder
+// templates/<theme>. If the theme does not declare any settings, a
+// ThemeSettings with an empty ID is returned.
+func GetThemeSettings(fsys fs.FS, theme string) (ThemeSettings, error) {
+	settings := ThemeSettings{Theme: theme}
+	dir := "templates/" + theme
+	// try js
+	b, err := fs.ReadFile(fsys, dir+"/templates-config.js")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return settings, erro.Wrap(err)
+	}
+	if err == nil {
+		m, err := evalJSConfig(b)
+		if err != nil {
+			return settings, erro.Wrap(err)
+		}
+		if m["settings"] != nil {
+			err = mapstructure.Decode(m["settings"], &settings)
+			if err != nil {
+				return settings, erro.Wrap(err)
+			}
+		}
+		return settings, settings.validate()
+	}
+	// try toml
+	b, err = fs.ReadFile(fsys, dir+"/templates-config.toml")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return settings, erro.Wrap(err)
+	}
+	if err == nil {
+		mainTree, err := toml.LoadBytes(b)
+		if err != nil {
+			return settings, erro.Wrap(err)
+		}
+		subTree, _ := mainTree.GetPath([]string{"settings"}).(*toml.Tree)
+		if subTree != nil {
+			err = subTree.Unmarshal(&settings)
+			if err != nil {
+				return settings, erro.Wrap(err)
+			}
+		}
+	}
+	return settings, settings.validate()
+}
+
+// ListThemeSettings returns the settings of every theme under templates/ that
+// declares any.
+func ListThemeSettings(fsys fs.FS) ([]ThemeSettings, error) {
+	entries, err := fs.ReadDir(fsys, "templates")
+	if err != nil {
+		return nil, erro.Wrap(err)
+	}
+	var list []ThemeSettings
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		settings, err := GetThemeSettings(fsys, entry.Name())
+		if err != nil {
+			return list, erro.Wrap(err)
+		}
+		if settings.ID != "" {
+			list = append(list, settings)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Theme < list[j].Theme })
+	return list, nil
+}
+
+func (settings ThemeSettings) validate() error {
+	if settings.ID == "" && len(settings.Fields) > 0 {
+		return fmt.Errorf("theme %s: settings declares fields but no id", settings.Theme)
+	}
+	seen := make(map[string]bool)
+	for _, field := range settings.Fields {
+		if field.Name == "" {
+			return fmt.Errorf("theme %s: settings field without a name", settings.Theme)
+		}
+		if seen[field.Name] {
+			return fmt.Errorf("theme %s: settings field %s declared more than once", settings.Theme, field.Name)
+		}
+		seen[field.Name] = true
+		if _, ok := settingsTypes[field.Type]; !ok {
+			return fmt.Errorf("theme %s: settings field %s has unknown type %q", settings.Theme, field.Name, field.Type)
+		}
+	}
+	return nil
+}
+
+// Parse converts the form value s into a value of the field's declared type.
+func (field SettingsField) Parse(s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	if field.Type == "bool" {
+		return s == "on" || s == "true" || s == "1", nil
+	}
+	if s == "" {
+		if field.Required {
+			return nil, fmt.Errorf("%s is required", field.DisplayName())
+		}
+		return nil, nil
+	}
+	switch field.Type {
+	case "int":
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a whole number", field.DisplayName())
+		}
+		return n, nil
+	case "float":
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a number", field.DisplayName())
+		}
+		return n, nil
+	case "url":
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme == "" && !strings.HasPrefix(s, "/")) {
+			return nil, fmt.Errorf("%s must be an absolute URL or a path starting with /", field.DisplayName())
+		}
+		return s, nil
+	default:
+		return s, nil
+	}
+}
+
+// DisplayName is the field's label, falling back to its name.
+func (field SettingsField) DisplayName() string {
+	if field.Label != "" {
+		return field.Label
+	}
+	return field.Name
+}
+
+// serveSettings serves the generated settings form of every theme under
+// /pm-settings/<theme>. /pm-settings/ itself lists the themes that have
+// settings.
+func (pm *PageManager) serveSettings(w http.ResponseWriter, r *http.Request) {
+	theme := strings.Trim(strings.TrimPrefix(r.URL.Path, "/pm-settings"), "/")
+	data := make(map[string]interface{})
+	if theme == "" || strings.Contains(theme, "/") {
+		list, err := ListThemeSettings(pm.fsys)
+		if err != nil {
+			http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+			return
+		}
+		data["Themes"] = list
+		err = pm.renderly.Page(w, r, "pagemanager::settings.html", nil, data)
+		if err != nil {
+			http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+		}
+		return
+	}
+	settings, err := GetThemeSettings(pm.fsys, path.Clean(theme))
+	if err != nil {
+		http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+		return
+	}
+	if settings.ID == "" {
+		http.NotFound(w, r)
+		return
+	}
+	values, err := pm.getSettingsValues(settings.ID)
+	if err != nil {
+		http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+		return
+	}
+	errmsgs := make(map[string]string)
+	if r.Method == http.MethodPost {
+		err = r.ParseForm()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		patch := make(map[string]interface{})
+		for _, field := range settings.Fields {
+			value, err := field.Parse(r.PostForm.Get(field.Name))
+			if err != nil {
+				errmsgs[field.Name] = err.Error()
+				values[field.Name] = r.PostForm.Get(field.Name)
+				continue
+			}
+			patch[field.Name] = value
+			if value == nil {
+				delete(values, field.Name)
+				continue
+			}
+			values[field.Name] = value
+		}
+		if len(errmsgs) == 0 {
+			ctx := requestContext(r)
+			err = pm.withTx(ctx, func(tx *sql.Tx) error {
+				return pm.publishSettings(ctx, tx, settings.ID, patch)
+			})
+			if err != nil {
+				http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, r.URL.Path+"?saved", http.StatusSeeOther)
+			return
+		}
+	}
+	for _, field := range settings.Fields {
+		if _, ok := values[field.Name]; !ok && field.Default != nil {
+			values[field.Name] = field.Default
+		}
+	}
+	_, saved := r.URL.Query()["saved"]
+	data["Settings"] = settings
+	data["Values"] = values
+	data["Errors"] = errmsgs
+	data["Saved"] = saved
+	err = pm.renderly.Page(w, r, "pagemanager::settings.html", nil, data)
+	if err != nil {
+		http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// publishSettings merge-patches the settings fields in patch into both the
+// published data and the pending draft of id, writing both at once with
+// replaceTemplateData. Settings forms have no edit mode to preview a draft
+// in, so saving them publishes straight away, but any other fields of id
+// that were drafted in edit mode stay unpublished.
+func (pm *PageManager) publishSettings(ctx context.Context, tx *sql.Tx, id string, patch map[string]interface{}) error {
+	var data, draft sql.NullString
+	err := tx.QueryRowContext(ctx, "SELECT data, draft FROM pm_templatedata WHERE id = ?", id).Scan(&data, &draft)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return erro.Wrap(err)
+	}
+	published, err := patchJSON(data.String, patch)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if draft.Valid {
+		draft.String, err = patchJSON(draft.String, patch)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	return pm.replaceTemplateData(ctx, tx, id, published, draft)
+}
+
+// patchJSON merge-patches patch into the JSON document s, which may be empty.
+func patchJSON(s string, patch map[string]interface{}) (string, error) {
+	var target interface{}
+	if s != "" {
+		err := json.Unmarshal([]byte(s), &target)
+		if err != nil {
+			return "", erro.Wrap(err)
+		}
+	}
+	b, err := json.Marshal(mergePatch(target, patch))
+	if err != nil {
+		return "", erro.Wrap(err)
+	}
+	return string(b), nil
+}
+
+// getSettingsValues returns the published JSON object stored in
+// pm_templatedata under id, or an empty map if there is none. Saving the
+// settings form publishes every field, so it is filled from the published
+// data rather than from a draft whose values would be published unseen.
+func (pm *PageManager) getSettingsValues(id string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	var data sql.NullString
+	err := pm.db.QueryRow("SELECT data FROM pm_templatedata WHERE id = ?", id).Scan(&data)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return values, erro.Wrap(err)
+	}
+	if data.Valid && data.String != "" {
+		err = json.Unmarshal([]byte(data.String), &values)
+		if err != nil {
+			return values, erro.Wrap(err)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,57 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+func TestPublishSettings(t *testing.T) {
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	const id = "settings:theme"
+	_, err := pm.db.Exec("INSERT INTO pm_templatedata (id, data, draft) VALUES (?, ?, ?)", id, `{"title":"published","tagline":"published"}`, `{"title":"drafted","tagline":"drafted"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The form must show the published values, since saving it publishes
+	// every field it submits.
+	values, err := pm.getSettingsValues(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["tagline"] != "published" {
+		t.Errorf("form tagline: got %v, want %q", values["tagline"], "published")
+	}
+
+	err = pm.withTx(ctx, func(tx *sql.Tx) error {
+		return pm.publishSettings(ctx, tx, id, map[string]interface{}{"title": "saved"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data, draft string
+	err = pm.db.QueryRow("SELECT data, draft FROM pm_templatedata WHERE id = ?", id).Scan(&data, &draft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"tagline":"published","title":"saved"}`; data != want {
+		t.Errorf("data: got %s, want %s", data, want)
+	}
+	if want := `{"tagline":"drafted","title":"saved"}`; draft != want {
+		t.Errorf("draft: got %s, want %s", draft, want)
+	}
+	var revisions, audits int
+	err = pm.db.QueryRow("SELECT COUNT(*) FROM pm_templatedata_revisions WHERE id = ?", id).Scan(&revisions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pm.db.QueryRow("SELECT COUNT(*) FROM pm_audit_log WHERE target = ?", "pm_templatedata:"+id).Scan(&audits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revisions != 1 || audits != 1 {
+		t.Errorf("got %d revisions and %d audit rows, want 1 of each", revisions, audits)
+	}
+}
@@ -0,0 +1,420 @@
+package pagemanager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bokwoon95/erro"
+)
+
+var storageBackend = flag.String("pm-storage", "local", "where uploaded files are stored: local (the datafolder), memory or s3")
+
+// Storage stores uploaded files. Names are slash-separated paths relative to
+// the datafolder, e.g. "pm-uploads/media/{hash}.jpg".
+//
+// Get and Stat return an error satisfying errors.Is(err, fs.ErrNotExist) if
+// there is no file called name. Deleting a file that does not exist is not
+// an error.
+type Storage interface {
+	Put(ctx context.Context, name string, r io.Reader) error
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	Delete(ctx context.Context, name string) error
+	// List returns every file whose name starts with prefix, sorted by name.
+	List(ctx context.Context, prefix string) ([]StorageInfo, error)
+	Stat(ctx context.Context, name string) (StorageInfo, error)
+}
+
+// StorageInfo describes a file in a Storage.
+type StorageInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// newStorage returns the Storage selected by -pm-storage.
+func newStorage(datafolder string) (Storage, error) {
+	switch *storageBackend {
+	case "local":
+		return NewLocalStorage(datafolder), nil
+	case "memory":
+		return NewMemoryStorage(), nil
+	case "s3":
+		return NewS3StorageFromFlags()
+	default:
+		return nil, fmt.Errorf("unknown -pm-storage %q, must be local, memory or s3", *storageBackend)
+	}
+}
+
+// readStorage returns the contents of the file name in storage. exists is
+// false if there is no such file.
+func readStorage(ctx context.Context, storage Storage, name string) (b []byte, exists bool, err error) {
+	rc, err := storage.Get(ctx, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, erro.Wrap(err)
+	}
+	defer rc.Close()
+	b, err = io.ReadAll(rc)
+	if err != nil {
+		return nil, false, erro.Wrap(err)
+	}
+	return b, true, nil
+}
+
+func checkStorageName(op, name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+// LocalStorage stores files in a folder on disk.
+type LocalStorage struct {
+	dir string
+}
+
+// NewLocalStorage returns a LocalStorage rooted at dir.
+func NewLocalStorage(dir string) *LocalStorage {
+	return &LocalStorage{dir: dir}
+}
+
+func (s *LocalStorage) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+// Put writes the file to a temporary file first and renames it into place,
+// so that readers never see a half written file.
+func (s *LocalStorage) Put(ctx context.Context, name string, r io.Reader) error {
+	if err := checkStorageName("put", name); err != nil {
+		return err
+	}
+	dst := s.path(name)
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	// The temporary file is created in the same folder so that the rename
+	// stays on one filesystem, with a unique name so that concurrent Puts
+	// of the same file do not write to the same temporary file.
+	f, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	tmp := f.Name()
+	// CreateTemp makes the file readable only by its owner.
+	err = f.Chmod(0644)
+	if err == nil {
+		_, err = io.Copy(f, r)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := checkStorageName("get", name); err != nil {
+		return nil, err
+	}
+	return os.Open(s.path(name))
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, name string) error {
+	if err := checkStorageName("delete", name); err != nil {
+		return err
+	}
+	err := os.Remove(s.path(name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+func (s *LocalStorage) List(ctx context.Context, prefix string) ([]StorageInfo, error) {
+	// Only walk the folder that contains prefix.
+	root := "."
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		root = prefix[:i]
+	}
+	var infos []StorageInfo
+	err := fs.WalkDir(os.DirFS(s.dir), root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == root && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() || !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		infos = append(infos, StorageInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return infos, erro.Wrap(err)
+	}
+	return infos, nil
+}
+
+func (s *LocalStorage) Stat(ctx context.Context, name string) (StorageInfo, error) {
+	if err := checkStorageName("stat", name); err != nil {
+		return StorageInfo{}, err
+	}
+	info, err := os.Stat(s.path(name))
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	if info.IsDir() {
+		return StorageInfo{}, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return StorageInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// MemoryStorage stores files in memory. It is meant for tests: its files are
+// lost when PageManager restarts.
+type MemoryStorage struct {
+	mu    sync.RWMutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	b       []byte
+	modTime time.Time
+}
+
+// NewMemoryStorage returns an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[string]memoryFile)}
+}
+
+func (s *MemoryStorage) Put(ctx context.Context, name string, r io.Reader) error {
+	if err := checkStorageName("put", name); err != nil {
+		return err
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = memoryFile{b: b, modTime: time.Now()}
+	return nil
+}
+
+func (s *MemoryStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	file, ok := s.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "get", Path: name, Err: fs.ErrNotExist}
+	}
+	return io.NopCloser(bytes.NewReader(file.b)), nil
+}
+
+func (s *MemoryStorage) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, name)
+	return nil
+}
+
+func (s *MemoryStorage) List(ctx context.Context, prefix string) ([]StorageInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var infos []StorageInfo
+	for name, file := range s.files {
+		if strings.HasPrefix(name, prefix) {
+			infos = append(infos, StorageInfo{Name: name, Size: int64(len(file.b)), ModTime: file.modTime})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func (s *MemoryStorage) Stat(ctx context.Context, name string) (StorageInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	file, ok := s.files[name]
+	if !ok {
+		return StorageInfo{}, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return StorageInfo{Name: name, Size: int64(len(file.b)), ModTime: file.modTime}, nil
+}
+
+// storageFS presents a Storage as a read-only fs.FS, so that it can be
+// served by http.FileServer and walked by fs.WalkDir. Folders are implied by
+// the names of the files in them.
+type storageFS struct {
+	storage Storage
+}
+
+func (fsys storageFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	ctx := context.Background()
+	if name != "." {
+		info, err := fsys.storage.Stat(ctx, name)
+		if err == nil {
+			b, _, err := readStorage(ctx, fsys.storage, name)
+			if err != nil {
+				return nil, err
+			}
+			return &storageFile{info: storageFileInfo{StorageInfo: info}, Reader: bytes.NewReader(b)}, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	infos, err := fsys.storage.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	// Keep only the direct children of name, turning deeper files into
+	// their top level folder.
+	dir := &storageDir{info: storageFileInfo{StorageInfo: StorageInfo{Name: name}, dir: true}}
+	seen := make(map[string]bool)
+	for _, info := range infos {
+		rest := strings.TrimPrefix(info.Name, prefix)
+		if i := strings.Index(rest, "/"); i >= 0 {
+			if !seen[rest[:i]] {
+				seen[rest[:i]] = true
+				dir.entries = append(dir.entries, storageFileInfo{StorageInfo: StorageInfo{Name: prefix + rest[:i]}, dir: true})
+			}
+			continue
+		}
+		dir.entries = append(dir.entries, storageFileInfo{StorageInfo: info})
+	}
+	sort.Slice(dir.entries, func(i, j int) bool { return dir.entries[i].Name() < dir.entries[j].Name() })
+	return dir, nil
+}
+
+// storageFileInfo is the fs.FileInfo and fs.DirEntry of a storageFS file or
+// folder.
+type storageFileInfo struct {
+	StorageInfo
+	dir bool
+}
+
+func (info storageFileInfo) Name() string       { return path.Base(info.StorageInfo.Name) }
+func (info storageFileInfo) Size() int64        { return info.StorageInfo.Size }
+func (info storageFileInfo) ModTime() time.Time { return info.StorageInfo.ModTime }
+func (info storageFileInfo) IsDir() bool        { return info.dir }
+func (info storageFileInfo) Sys() interface{}   { return nil }
+
+func (info storageFileInfo) Mode() fs.FileMode {
+	if info.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (info storageFileInfo) Type() fs.FileMode          { return info.Mode().Type() }
+func (info storageFileInfo) Info() (fs.FileInfo, error) { return info, nil }
+
+// storageFile is a file opened from a storageFS. It is read into memory so
+// that http.FileServer can seek in it.
+type storageFile struct {
+	*bytes.Reader
+	info storageFileInfo
+}
+
+func (f *storageFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *storageFile) Close() error               { return nil }
+
+type storageDir struct {
+	info    storageFileInfo
+	entries []storageFileInfo
+	offset  int
+}
+
+func (d *storageDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *storageDir) Close() error               { return nil }
+
+func (d *storageDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.StorageInfo.Name, Err: errors.New("is a directory")}
+}
+
+func (d *storageDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n > 0 && len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(remaining) {
+		remaining = remaining[:n]
+	}
+	entries := make([]fs.DirEntry, len(remaining))
+	for i := range remaining {
+		entries[i] = remaining[i]
+	}
+	d.offset += len(remaining)
+	return entries, nil
+}
+
+// uploadsOverlayFS serves the uploads folder from a Storage and everything
+// else from the datafolder.
+type uploadsOverlayFS struct {
+	datafolder fs.FS
+	uploads    fs.FS
+}
+
+func (fsys uploadsOverlayFS) Open(name string) (fs.File, error) {
+	if name == uploadsDir || strings.HasPrefix(name, uploadsDir+"/") {
+		return fsys.uploads.Open(name)
+	}
+	return fsys.datafolder.Open(name)
+}
+
+// fileStorage returns where the file name (relative to the datafolder) is
+// stored: pm.storage if it is in the uploads folder, the datafolder
+// otherwise.
+func (pm *PageManager) fileStorage(name string) Storage {
+	if strings.HasPrefix(name, uploadsDir+"/") {
+		return pm.storage
+	}
+	return NewLocalStorage(pm.datafolder)
+}
+
+// writeFile writes b to name (relative to the datafolder), storing it in
+// pm.storage if it is in the uploads folder.
+func (pm *PageManager) writeFile(ctx context.Context, name string, b []byte) error {
+	return pm.fileStorage(name).Put(ctx, name, bytes.NewReader(b))
+}
+
+// deleteFile deletes name (relative to the datafolder), from pm.storage if
+// it is in the uploads folder.
+func (pm *PageManager) deleteFile(ctx context.Context, name string) error {
+	return pm.fileStorage(name).Delete(ctx, name)
+}
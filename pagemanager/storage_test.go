@@ -0,0 +1,135 @@
+package pagemanager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestStorage checks that every Storage behaves the same, as described by
+// the Storage interface.
+func TestStorage(t *testing.T) {
+	storages := map[string]func(t *testing.T) Storage{
+		"local":  func(t *testing.T) Storage { return NewLocalStorage(t.TempDir()) },
+		"memory": func(t *testing.T) Storage { return NewMemoryStorage() },
+		"s3": func(t *testing.T) Storage {
+			_, s := newFakeS3(t)
+			return s
+		},
+	}
+	for name, newStorage := range storages {
+		t.Run(name, func(t *testing.T) {
+			testStorage(t, newStorage(t))
+		})
+	}
+}
+
+func testStorage(t *testing.T, s Storage) {
+	ctx := context.Background()
+	read := func(name string) string {
+		t.Helper()
+		b, exists, err := readStorage(ctx, s, name)
+		if err != nil {
+			t.Fatalf("Get %s: %v", name, err)
+		}
+		if !exists {
+			t.Fatalf("Get %s: file does not exist", name)
+		}
+		return string(b)
+	}
+	if _, err := s.Get(ctx, "pm-uploads/missing.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get of a missing file: got %v, want fs.ErrNotExist", err)
+	}
+	if _, err := s.Stat(ctx, "pm-uploads/missing.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of a missing file: got %v, want fs.ErrNotExist", err)
+	}
+	if err := s.Delete(ctx, "pm-uploads/missing.jpg"); err != nil {
+		t.Errorf("Delete of a missing file: %v", err)
+	}
+	if err := s.Put(ctx, "../outside.jpg", strings.NewReader("x")); err == nil {
+		t.Error("Put of ../outside.jpg succeeded")
+	}
+	files := map[string]string{
+		"pm-uploads/a.jpg":          "a",
+		"pm-uploads/media/b.jpg":    "bb",
+		"pm-uploads/media/c d.jpg":  "ccc",
+		"pm-uploads/media2/e.jpg":   "eeee",
+		"templates/plainsimple.css": "css",
+	}
+	for name, content := range files {
+		if err := s.Put(ctx, name, strings.NewReader(content)); err != nil {
+			t.Fatalf("Put %s: %v", name, err)
+		}
+	}
+	for name, content := range files {
+		if got := read(name); got != content {
+			t.Errorf("Get %s = %q, want %q", name, got, content)
+		}
+		info, err := s.Stat(ctx, name)
+		if err != nil {
+			t.Errorf("Stat %s: %v", name, err)
+		} else if info.Name != name || info.Size != int64(len(content)) {
+			t.Errorf("Stat %s = %+v, want the name %s and a size of %d", name, info, name, len(content))
+		}
+	}
+	if err := s.Put(ctx, "pm-uploads/a.jpg", strings.NewReader("overwritten")); err != nil {
+		t.Fatal(err)
+	}
+	if got := read("pm-uploads/a.jpg"); got != "overwritten" {
+		t.Errorf("Get after overwriting = %q, want %q", got, "overwritten")
+	}
+	for prefix, want := range map[string]string{
+		"pm-uploads/media/": "pm-uploads/media/b.jpg,pm-uploads/media/c d.jpg",
+		"pm-uploads/media":  "pm-uploads/media/b.jpg,pm-uploads/media/c d.jpg,pm-uploads/media2/e.jpg",
+		"pm-uploads/":       "pm-uploads/a.jpg,pm-uploads/media/b.jpg,pm-uploads/media/c d.jpg,pm-uploads/media2/e.jpg",
+		"nothing/":          "",
+	} {
+		infos, err := s.List(ctx, prefix)
+		if err != nil {
+			t.Fatalf("List %s: %v", prefix, err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name)
+		}
+		if got := strings.Join(names, ","); got != want {
+			t.Errorf("List %s = %s, want %s", prefix, got, want)
+		}
+	}
+	if err := s.Delete(ctx, "pm-uploads/media/b.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "pm-uploads/media/b.jpg"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Get after Delete: got %v, want fs.ErrNotExist", err)
+	}
+	// Concurrent Puts of the same file must leave one whole version of it
+	// and nothing else behind.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			content := bytes.Repeat([]byte(fmt.Sprint(i)), 1<<14)
+			if err := s.Put(ctx, "pm-uploads/race/file.jpg", bytes.NewReader(content)); err != nil {
+				t.Errorf("concurrent Put: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	got := read("pm-uploads/race/file.jpg")
+	if len(got) != 1<<14 || strings.Count(got, got[:1]) != len(got) {
+		t.Errorf("concurrent Puts left a mixed or truncated file of %d bytes", len(got))
+	}
+	infos, err := s.List(ctx, "pm-uploads/race/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Errorf("concurrent Puts left %d files behind: %+v", len(infos), infos)
+	}
+}
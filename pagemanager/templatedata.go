@@ -0,0 +1,395 @@
+package pagemanager
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bokwoon95/erro"
+)
+
+var revisionLimit = flag.Int("pm-revisions", 50, "number of revisions kept per pm_templatedata ID (0 keeps every revision)")
+
+type contextKey string
+
+const authorContextKey contextKey = "author"
+
+// WithAuthor returns a copy of ctx that attributes any pm_templatedata writes
+// made with it to author.
+func WithAuthor(ctx context.Context, author string) context.Context {
+	return context.WithValue(ctx, authorContextKey, author)
+}
+
+func authorFromContext(ctx context.Context) string {
+	author, _ := ctx.Value(authorContextKey).(string)
+	return author
+}
+
+// requestAuthor identifies who made the request r. PageManager has no login
+// system of its own, so this is the basic auth username set by whatever sits
+// in front of it, if any. PageManager does not check the password: the
+// author in the revision history and the actor in the audit log can only be
+// trusted if a proxy in front of it authenticates every request to the
+// pm-* endpoints, since otherwise a client can claim any username.
+func requestAuthor(r *http.Request) string {
+	username, _, _ := r.BasicAuth()
+	return username
+}
+
+// requestContext returns the context that changes made on behalf of r
+// should use, so that they are attributed to its author and remote address.
+func requestContext(r *http.Request) context.Context {
+	return WithRemoteAddr(WithAuthor(r.Context(), requestAuthor(r)), r.RemoteAddr)
+}
+
+// withTx runs fn inside a transaction, committing it if fn returns nil and
+// rolling it back otherwise.
+func (pm *PageManager) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := pm.db.BeginTx(ctx, nil)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	defer tx.Rollback()
+	err = fn(tx)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// saveTemplateData sanitizes data and sets it as the draft data of id in
+// pm_templatedata, bumping its updated_at and appending it to the revision
+// history of id. The draft is only visible in edit mode until it is published
+// with publishTemplateData. Every write to pm_templatedata must go through
+// saveTemplateData, publishTemplateData or replaceTemplateData.
+func (pm *PageManager) saveTemplateData(ctx context.Context, tx *sql.Tx, id string, data string) error {
+	data, err := pm.sanitizeTemplateData(id, data)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	var before sql.NullString
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(draft, data) FROM pm_templatedata WHERE id = ?", id).Scan(&before)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return erro.Wrap(err)
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO pm_templatedata (id, draft, updated_at) VALUES (?, ?, ?) ON CONFLICT (id) DO UPDATE SET draft = EXCLUDED.draft, updated_at = EXCLUDED.updated_at", id, data, time.Now().UTC())
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = pm.recordRevision(ctx, tx, id, data, false)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = audit(ctx, tx, AuditSave, "pm_templatedata:"+id, contentHash([]byte(before.String), before.Valid), contentHash([]byte(data), true))
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// publishTemplateData promotes the draft data of id to its published data,
+// which is what visitors see (and what the search index holds). It is a
+// no-op if id has no draft.
+func (pm *PageManager) publishTemplateData(ctx context.Context, tx *sql.Tx, id string) error {
+	var data, draft sql.NullString
+	err := tx.QueryRowContext(ctx, "SELECT data, draft FROM pm_templatedata WHERE id = ?", id).Scan(&data, &draft)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if !draft.Valid {
+		return nil
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE pm_templatedata SET data = draft, draft = NULL WHERE id = ?", id)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = pm.recordRevision(ctx, tx, id, draft.String, true)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = audit(ctx, tx, AuditPublish, "pm_templatedata:"+id, contentHash([]byte(data.String), data.Valid), contentHash([]byte(draft.String), true))
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = pm.indexPage(ctx, tx, id)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+// replaceTemplateData sets the published data of id to data and its pending
+// draft to draft (no draft if it is not valid) in a single write, sanitizing
+// both like saveTemplateData. data is recorded as a published revision and
+// in the audit log as a publish, and the search index of id is updated.
+func (pm *PageManager) replaceTemplateData(ctx context.Context, tx *sql.Tx, id string, data string, draft sql.NullString) error {
+	data, err := pm.sanitizeTemplateData(id, data)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if draft.Valid {
+		draft.String, err = pm.sanitizeTemplateData(id, draft.String)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	var before sql.NullString
+	err = tx.QueryRowContext(ctx, "SELECT data FROM pm_templatedata WHERE id = ?", id).Scan(&before)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return erro.Wrap(err)
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO pm_templatedata (id, data, draft, updated_at) VALUES (?, ?, ?, ?) ON CONFLICT (id) DO UPDATE SET data = EXCLUDED.data, draft = EXCLUDED.draft, updated_at = EXCLUDED.updated_at", id, data, draft, time.Now().UTC())
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = pm.recordRevision(ctx, tx, id, data, true)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = audit(ctx, tx, AuditPublish, "pm_templatedata:"+id, contentHash([]byte(before.String), before.Valid), contentHash([]byte(data), true))
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	err = pm.indexPage(ctx, tx, id)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	return nil
+}
+
+func (pm *PageManager) recordRevision(ctx context.Context, tx *sql.Tx, id string, data string, published bool) error {
+	_, err := tx.ExecContext(ctx, "INSERT INTO pm_templatedata_revisions (id, data, created_at, author, published) VALUES (?, ?, ?, ?, ?)", id, data, time.Now().UTC(), authorFromContext(ctx), published)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if *revisionLimit > 0 {
+		query := `DELETE FROM pm_templatedata_revisions
+			WHERE id = ? AND revision_id NOT IN (
+				SELECT revision_id FROM pm_templatedata_revisions WHERE id = ? ORDER BY revision_id DESC LIMIT ?
+			)`
+		_, err = tx.ExecContext(ctx, query, id, id, *revisionLimit)
+		if err != nil {
+			return erro.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// Publish atomically publishes the drafts of every given ID: either all of
+// them are published or none are.
+func (pm *PageManager) Publish(ctx context.Context, ids ...string) error {
+	return pm.withTx(ctx, func(tx *sql.Tx) error {
+		for _, id := range ids {
+			err := pm.publishTemplateData(ctx, tx, id)
+			if err != nil {
+				return erro.Wrap(err)
+			}
+		}
+		return nil
+	})
+}
+
+// servePublish publishes the drafts of the IDs given by the id form values,
+// e.g. POST /pm-publish with id=/about-me&id=mytheme-globals.
+func (pm *PageManager) servePublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ids := r.PostForm["id"]
+	if len(ids) == 0 {
+		http.Error(w, "id missing", http.StatusBadRequest)
+		return
+	}
+	err = pm.Publish(requestContext(r), ids...)
+	if err != nil {
+		http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"published": ids})
+}
+
+// Revision is a past value of a pm_templatedata ID.
+type Revision struct {
+	RevisionID int64           `json:"revision_id"`
+	ID         string          `json:"id"`
+	Data       json.RawMessage `json:"data,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Author     string          `json:"author"`
+	Published  bool            `json:"published"`
+}
+
+// ListRevisions returns the revisions of id, newest first. The revision data
+// is left out; use GetRevision to fetch it.
+func (pm *PageManager) ListRevisions(id string) ([]Revision, error) {
+	var revisions []Revision
+	rows, err := pm.db.Query("SELECT revision_id, id, created_at, author, published FROM pm_templatedata_revisions WHERE id = ? ORDER BY revision_id DESC", id)
+	if err != nil {
+		return revisions, erro.Wrap(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var revision Revision
+		var author sql.NullString
+		var published sql.NullBool
+		err = rows.Scan(&revision.RevisionID, &revision.ID, &revision.CreatedAt, &author, &published)
+		if err != nil {
+			return revisions, erro.Wrap(err)
+		}
+		revision.Author = author.String
+		revision.Published = published.Bool
+		revisions = append(revisions, revision)
+	}
+	err = rows.Err()
+	if err != nil {
+		return revisions, erro.Wrap(err)
+	}
+	return revisions, nil
+}
+
+// GetRevision returns the revision identified by revisionID. It returns
+// sql.ErrNoRows if there is no such revision.
+func (pm *PageManager) GetRevision(revisionID int64) (Revision, error) {
+	var revision Revision
+	var data, author sql.NullString
+	var published sql.NullBool
+	err := pm.db.
+		QueryRow("SELECT revision_id, id, data, created_at, author, published FROM pm_templatedata_revisions WHERE revision_id = ?", revisionID).
+		Scan(&revision.RevisionID, &revision.ID, &data, &revision.CreatedAt, &author, &published)
+	if errors.Is(err, sql.ErrNoRows) {
+		return revision, err
+	}
+	if err != nil {
+		return revision, erro.Wrap(err)
+	}
+	if data.Valid {
+		revision.Data = json.RawMessage(data.String)
+	}
+	revision.Author = author.String
+	revision.Published = published.Bool
+	return revision, nil
+}
+
+// errEmptyRevision is returned by RestoreRevision for a revision without data.
+var errEmptyRevision = errors.New("revision has no data to restore")
+
+// RestoreRevision sets the draft of the revision's ID back to the data of the
+// revision, so that it can be reviewed in edit mode before being published.
+// The restore is itself recorded as a new revision, so it can be undone. A
+// revision without data cannot be restored, since saving it would leave an
+// empty draft rather than a deletion; RestoreRevision returns
+// errEmptyRevision for it.
+func (pm *PageManager) RestoreRevision(ctx context.Context, revisionID int64) error {
+	revision, err := pm.GetRevision(revisionID)
+	if err != nil {
+		return erro.Wrap(err)
+	}
+	if revision.Data == nil {
+		return errEmptyRevision
+	}
+	return pm.withTx(ctx, func(tx *sql.Tx) error {
+		return pm.saveTemplateData(ctx, tx, revision.ID, string(revision.Data))
+	})
+}
+
+// serveRevisions serves the revision history API:
+//
+// GET /pm-revisions?id={id} lists the revisions of a pm_templatedata ID.
+//
+// GET /pm-revisions/{revision_id} returns a revision together with its data.
+//
+// POST /pm-revisions/{revision_id}/restore restores a revision.
+func (pm *PageManager) serveRevisions(w http.ResponseWriter, r *http.Request) {
+	p := strings.Trim(strings.TrimPrefix(r.URL.Path, "/pm-revisions"), "/")
+	if p == "" {
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "id missing", http.StatusBadRequest)
+			return
+		}
+		revisions, err := pm.ListRevisions(id)
+		if err != nil {
+			http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, revisions)
+		return
+	}
+	var restore bool
+	if strings.HasSuffix(p, "/restore") {
+		p = strings.TrimSuffix(p, "/restore")
+		restore = true
+	}
+	revisionID, err := strconv.ParseInt(p, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	revision, err := pm.GetRevision(revisionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+		return
+	}
+	if restore {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		err = pm.RestoreRevision(requestContext(r), revisionID)
+		if errors.Is(err, errEmptyRevision) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, revision)
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, erro.Sdump(err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(b)
+}
+
+// parseRevisionID parses a revision ID given on the command line.
+func parseRevisionID(s string) (int64, error) {
+	revisionID, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid revision ID %q", s)
+	}
+	return revisionID, nil
+}
@@ -0,0 +1,55 @@
+package pagemanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRestoreRevision(t *testing.T) {
+	pm := newTestPageManager(t)
+	ctx := context.Background()
+	const id = "posts:hello"
+	result, err := pm.db.Exec("INSERT INTO pm_templatedata_revisions (id, data, created_at, published) VALUES (?, NULL, CURRENT_TIMESTAMP, TRUE)", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emptyID, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = pm.db.Exec("INSERT INTO pm_templatedata_revisions (id, data, created_at, published) VALUES (?, ?, CURRENT_TIMESTAMP, TRUE)", id, `{"title":"hello"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revisionID, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pm.RestoreRevision(ctx, emptyID)
+	if !errors.Is(err, errEmptyRevision) {
+		t.Fatalf("restoring a revision without data: got %v, want errEmptyRevision", err)
+	}
+	var n int
+	err = pm.db.QueryRow("SELECT COUNT(*) FROM pm_templatedata WHERE id = ?", id).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("restoring a revision without data saved a draft")
+	}
+
+	err = pm.RestoreRevision(ctx, revisionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var draft string
+	err = pm.db.QueryRow("SELECT draft FROM pm_templatedata WHERE id = ?", id).Scan(&draft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if draft != `{"title":"hello"}` {
+		t.Errorf("draft: got %s, want %s", draft, `{"title":"hello"}`)
+	}
+}
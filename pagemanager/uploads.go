@@ -0,0 +1,263 @@
+package pagemanager
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	uploadMaxFileSize    = flag.Int64("pm-upload-max-file-size", 10<<20, "maximum size in bytes of a single uploaded file")
+	uploadMaxRequestSize = flag.Int64("pm-upload-max-request-size", 32<<20, "maximum size in bytes of a request uploading files")
+	uploadTypes          = flag.String("pm-upload-types", "image/jpeg,image/png,image/gif,image/webp", "comma separated MIME types that may be uploaded, as detected from the file contents")
+	uploadMaxWidth       = flag.Int("pm-upload-max-width", 8000, "maximum width in pixels of uploaded images (0 for no limit)")
+	uploadMaxHeight      = flag.Int("pm-upload-max-height", 8000, "maximum height in pixels of uploaded images (0 for no limit)")
+)
+
+// uploadExtensions are the file extensions that uploads of each MIME type
+// (as sniffed by http.DetectContentType) may have, the first being the one
+// given to files uploaded without an extension. It is fixed rather than
+// taken from the mime package, whose table depends on the host (e.g.
+// image/jpeg may map to .jfif first, or a type may have no entry at all).
+// Every type in -pm-upload-types must be listed here.
+var uploadExtensions = map[string][]string{
+	"image/jpeg":      {".jpg", ".jpeg"},
+	"image/png":       {".png"},
+	"image/gif":       {".gif"},
+	"image/webp":      {".webp"},
+	"image/bmp":       {".bmp"},
+	"image/x-icon":    {".ico"},
+	"application/pdf": {".pdf"},
+	"audio/mpeg":      {".mp3"},
+	"audio/wave":      {".wav"},
+	"video/mp4":       {".mp4"},
+	"video/webm":      {".webm"},
+	"text/plain":      {".txt"},
+}
+
+// checkUploadTypes checks that every type in -pm-upload-types has its
+// extensions listed in uploadExtensions.
+func checkUploadTypes() error {
+	for _, typ := range strings.Split(*uploadTypes, ",") {
+		typ = strings.TrimSpace(typ)
+		if _, ok := uploadExtensions[typ]; !ok {
+			return fmt.Errorf("-pm-upload-types: unsupported type %q", typ)
+		}
+	}
+	return nil
+}
+
+// UploadError is an uploaded file rejected by the upload rules. It is sent
+// to the editor as {"error": UploadError} so that it can display Message.
+type UploadError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"` // request_too_large, file_too_large, type_not_allowed, type_mismatch, invalid_image, image_too_large, invalid_filename, invalid_crop or no_original
+	Message string `json:"message"`
+	File    string `json:"file,omitempty"`
+}
+
+func (e *UploadError) Error() string {
+	if e.File == "" {
+		return e.Message
+	}
+	return e.File + ": " + e.Message
+}
+
+func writeUploadError(w http.ResponseWriter, err *UploadError) {
+	writeJSON(w, err.Status, map[string]interface{}{"error": err})
+}
+
+// limitUploadRequest caps the size of the body of r at -pm-upload-max-request-size.
+func limitUploadRequest(w http.ResponseWriter, r *http.Request) {
+	r.Body = &limitedBody{
+		ReadCloser: http.MaxBytesReader(w, r.Body, *uploadMaxRequestSize),
+		limit:      *uploadMaxRequestSize,
+	}
+}
+
+// errBodyTooLarge is the error returned by a limitedBody read past its limit.
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedBody wraps the http.MaxBytesReader of limitUploadRequest so that
+// exceeding the limit can be told apart from other read errors without
+// matching error strings: Go 1.16 has no http.MaxBytesError. The error is
+// replaced with errBodyTooLarge, and also recorded in tooLarge since some
+// readers (e.g. mime/multipart) do not wrap the errors they return.
+type limitedBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	tooLarge bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		b.tooLarge = true
+		err = errBodyTooLarge
+	}
+	return n, err
+}
+
+// requestTooLarge returns the UploadError for a request whose body could not
+// be read because it exceeds -pm-upload-max-request-size, or nil if err is
+// some other error.
+func requestTooLarge(r *http.Request, err error) *UploadError {
+	if err == nil {
+		return nil
+	}
+	body, _ := r.Body.(*limitedBody)
+	if !errors.Is(err, errBodyTooLarge) && (body == nil || !body.tooLarge) {
+		return nil
+	}
+	return &UploadError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    "request_too_large",
+		Message: fmt.Sprintf("the upload is larger than the limit of %s", formatBytes(*uploadMaxRequestSize)),
+	}
+}
+
+// checkUploadSize returns an UploadError if an uploaded file of size bytes
+// exceeds -pm-upload-max-file-size.
+func checkUploadSize(filename string, size int64) *UploadError {
+	if size <= *uploadMaxFileSize {
+		return nil
+	}
+	return &UploadError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    "file_too_large",
+		Message: fmt.Sprintf("file is %s, larger than the limit of %s", formatBytes(size), formatBytes(*uploadMaxFileSize)),
+		File:    filename,
+	}
+}
+
+// validateUpload checks the contents b of the uploaded file filename against
+// the upload rules. The file type is sniffed from its contents; if filename
+// has an extension, it must agree with the sniffed type.
+func validateUpload(filename string, b []byte) *UploadError {
+	if err := checkUploadSize(filename, int64(len(b))); err != nil {
+		return err
+	}
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(b))
+	allowed := false
+	for _, typ := range strings.Split(*uploadTypes, ",") {
+		if strings.TrimSpace(typ) == mimeType {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return &UploadError{
+			Status:  http.StatusUnsupportedMediaType,
+			Code:    "type_not_allowed",
+			Message: fmt.Sprintf("%s files are not allowed, only %s", mimeType, strings.ReplaceAll(*uploadTypes, ",", ", ")),
+			File:    filename,
+		}
+	}
+	if ext := strings.ToLower(path.Ext(filename)); ext != "" {
+		matches := false
+		for _, e := range uploadExtensions[mimeType] {
+			if e == ext {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			return &UploadError{
+				Status:  http.StatusUnsupportedMediaType,
+				Code:    "type_mismatch",
+				Message: fmt.Sprintf("file contents are %s, which does not match its %s extension", mimeType, ext),
+				File:    filename,
+			}
+		}
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		return nil
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		// Formats without a registered decoder (e.g. webp) cannot have
+		// their dimensions checked.
+		if err == image.ErrFormat {
+			return nil
+		}
+		return &UploadError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "invalid_image",
+			Message: "image could not be read: " + err.Error(),
+			File:    filename,
+		}
+	}
+	if (*uploadMaxWidth > 0 && config.Width > *uploadMaxWidth) || (*uploadMaxHeight > 0 && config.Height > *uploadMaxHeight) {
+		return &UploadError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "image_too_large",
+			Message: fmt.Sprintf("image is %dx%d pixels, larger than the limit of %dx%d", config.Width, config.Height, *uploadMaxWidth, *uploadMaxHeight),
+			File:    filename,
+		}
+	}
+	return nil
+}
+
+// prepareUpload strips the metadata of the uploaded file b unless
+// keepMetadata is set, reporting whether it did. Files in a format that
+// stripMetadata does not handle are kept as is and reported as not stripped.
+func prepareUpload(filename string, b []byte, keepMetadata bool) (out []byte, stripped bool, uerr *UploadError) {
+	if keepMetadata || !canStripMetadata(b) {
+		return b, false, nil
+	}
+	out, err := stripMetadata(b)
+	if err != nil {
+		return nil, false, &UploadError{
+			Status:  http.StatusUnprocessableEntity,
+			Code:    "invalid_image",
+			Message: "metadata could not be removed: " + err.Error(),
+			File:    filename,
+		}
+	}
+	return out, true, nil
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// normalizeFilename turns name into a lowercase filename made only of
+// letters, digits, dashes and underscores (plus its extension), e.g.
+// "C:\Photos\My Holiday (1).JPG" becomes "my-holiday-1.jpg".
+func normalizeFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.ToLower(name)
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	stem = strings.Trim(unsafeFilenameChars.ReplaceAllString(stem, "-"), "-")
+	ext = unsafeFilenameChars.ReplaceAllString(strings.TrimPrefix(ext, "."), "")
+	if len(stem) > 100 {
+		stem = strings.TrimRight(stem[:100], "-")
+	}
+	if stem == "" {
+		stem = "file"
+	}
+	if ext == "" {
+		return stem
+	}
+	return stem + "." + ext
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
@@ -0,0 +1,154 @@
+package pagemanager
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeFilename(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"hero.jpg", "hero.jpg"},
+		{"My Holiday (1).JPG", "my-holiday-1.jpg"},
+		{`C:\Photos\My Holiday (1).JPG`, "my-holiday-1.jpg"},
+		{"/etc/passwd", "passwd"},
+		{"../../secret.png", "secret.png"},
+		{"ünïcödé.png", "n-c-d.png"},
+		{"???.gif", "file.gif"},
+		{".htaccess", "file.htaccess"},
+		{"noext", "noext"},
+		{"a.tar.gz", "a-tar.gz"},
+		{"photo.j p g", "photo.jpg"},
+	}
+	for _, tt := range tests {
+		if got := normalizeFilename(tt.name); got != tt.want {
+			t.Errorf("normalizeFilename(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, image.NewRGBA(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestValidateUpload(t *testing.T) {
+	small := encodePNG(t, 4, 4)
+	tests := []struct {
+		filename string
+		b        []byte
+		code     string // empty if the upload is valid
+	}{
+		{"hero.png", small, ""},
+		{"hero", small, ""},
+		{"hero.jpg", small, "type_mismatch"},
+		{"hero.jpeg", encodeJPEG(t, 4, 4), ""},
+		{"hero.jfif", encodeJPEG(t, 4, 4), "type_mismatch"},
+		{"hero.png", []byte("<html><script>alert(1)</script></html>"), "type_not_allowed"},
+		{"hero.png", []byte("%PDF-1.4 not an image"), "type_not_allowed"},
+		{"hero.png", small[:20], "invalid_image"},
+		{"hero.png", encodePNG(t, *uploadMaxWidth+1, 1), "image_too_large"},
+		{"hero.png", make([]byte, *uploadMaxFileSize+1), "file_too_large"},
+	}
+	for _, tt := range tests {
+		uerr := validateUpload(tt.filename, tt.b)
+		var code string
+		if uerr != nil {
+			code = uerr.Code
+		}
+		if code != tt.code {
+			t.Errorf("validateUpload(%q, %d bytes) = %v, want code %q", tt.filename, len(tt.b), uerr, tt.code)
+		}
+	}
+}
+
+func TestCheckUploadTypes(t *testing.T) {
+	defer func(types string) { *uploadTypes = types }(*uploadTypes)
+	if err := checkUploadTypes(); err != nil {
+		t.Errorf("default -pm-upload-types: %v", err)
+	}
+	*uploadTypes = "image/png, application/x-unknown"
+	if err := checkUploadTypes(); err == nil {
+		t.Error("a type without known extensions was accepted")
+	}
+}
+
+func TestRequestTooLarge(t *testing.T) {
+	defer func(n int64) { *uploadMaxRequestSize = n }(*uploadMaxRequestSize)
+	*uploadMaxRequestSize = 1 << 10
+	newRequest := func(size int) *http.Request {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		fw, err := mw.CreateFormFile("file", "hero.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(bytes.Repeat([]byte("x"), size))
+		mw.Close()
+		r := httptest.NewRequest(http.MethodPost, "/pm-media", body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		limitUploadRequest(httptest.NewRecorder(), r)
+		return r
+	}
+	r := newRequest(100)
+	if uerr := requestTooLarge(r, r.ParseMultipartForm(32<<20)); uerr != nil {
+		t.Errorf("small request: got %v, want nil", uerr)
+	}
+	r = newRequest(2 << 10)
+	uerr := requestTooLarge(r, r.ParseMultipartForm(32<<20))
+	if uerr == nil || uerr.Code != "request_too_large" {
+		t.Errorf("large request: got %v, want request_too_large", uerr)
+	}
+	if uerr := requestTooLarge(r, errors.New("unexpected EOF")); uerr == nil {
+		t.Error("large request: an unwrapped error was not recognized")
+	}
+}
+
+func TestPrepareUploadStripped(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		b            []byte
+		keepMetadata bool
+		want         bool
+	}{
+		{"a.png", buf.Bytes(), false, true},
+		{"a.png", buf.Bytes(), true, false},
+		{"a.gif", []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00\x3B"), false, true},
+		{"a.bmp", []byte("BM not a format that metadata is stripped from"), false, false},
+	}
+	for _, tt := range tests {
+		_, stripped, uerr := prepareUpload(tt.name, tt.b, tt.keepMetadata)
+		if uerr != nil {
+			t.Errorf("prepareUpload(%s, keepMetadata=%v): %v", tt.name, tt.keepMetadata, uerr)
+			continue
+		}
+		if stripped != tt.want {
+			t.Errorf("prepareUpload(%s, keepMetadata=%v) stripped = %v, want %v", tt.name, tt.keepMetadata, stripped, tt.want)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package pagemanager
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bokwoon95/pagemanager-data/renderly"
+)
+
+var videoProviders = flag.String("pm-video-providers", "youtube,vimeo,dailymotion", "comma separated video providers whose URLs may be embedded in video fields, out of "+strings.Join(videoProviderNames(), ", "))
+
+// VideoProvider is a video site whose videos may be embedded in a page. Its
+// videos are recognized by URL alone, no requests are made to the provider.
+type VideoProvider struct {
+	Name string
+	// Patterns match the URLs of a video (without the scheme) and capture
+	// its ID in their first group.
+	Patterns  []*regexp.Regexp
+	IDPattern *regexp.Regexp // all valid video IDs
+	EmbedURL  string         // URL of the embeddable player, with a %s for the video ID
+	FrameSrc  string         // Content-Security-Policy frame-src source that allows EmbedURL
+}
+
+// VideoProviders are the video providers that -pm-video-providers may pick
+// from. Programs embedding PageManager may add their own before calling New.
+var VideoProviders = map[string]VideoProvider{
+	"youtube": {
+		Name: "youtube",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`^(?:www\.|m\.)?youtube(?:-nocookie)?\.com/(?:watch\?(?:.*&)?v=|embed/|shorts/|live/|v/)([A-Za-z0-9_-]{11})(?:[?&#/].*)?$`),
+			regexp.MustCompile(`^youtu\.be/([A-Za-z0-9_-]{11})(?:[?#/].*)?$`),
+		},
+		IDPattern: regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`),
+		EmbedURL:  "https://www.youtube-nocookie.com/embed/%s",
+		FrameSrc:  "https://www.youtube-nocookie.com",
+	},
+	"vimeo": {
+		Name: "vimeo",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`^(?:www\.)?vimeo\.com/(?:channels/[A-Za-z0-9_-]+/|groups/[A-Za-z0-9_-]+/videos/|video/)?([0-9]+)(?:[?#/].*)?$`),
+			regexp.MustCompile(`^player\.vimeo\.com/video/([0-9]+)(?:[?#/].*)?$`),
+		},
+		IDPattern: regexp.MustCompile(`^[0-9]+$`),
+		EmbedURL:  "https://player.vimeo.com/video/%s?dnt=1",
+		FrameSrc:  "https://player.vimeo.com",
+	},
+	"dailymotion": {
+		Name: "dailymotion",
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`^(?:www\.)?dailymotion\.com/(?:embed/)?video/([A-Za-z0-9]+)(?:[?#/_].*)?$`),
+			regexp.MustCompile(`^dai\.ly/([A-Za-z0-9]+)(?:[?#/].*)?$`),
+		},
+		IDPattern: regexp.MustCompile(`^[A-Za-z0-9]+$`),
+		EmbedURL:  "https://www.dailymotion.com/embed/video/%s",
+		FrameSrc:  "https://www.dailymotion.com",
+	},
+}
+
+func videoProviderNames() []string {
+	names := make([]string, 0, len(VideoProviders))
+	for name := range VideoProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newVideoProviders returns the providers named in the comma separated list
+// names (the value of -pm-video-providers).
+func newVideoProviders(names string) (map[string]VideoProvider, error) {
+	providers := make(map[string]VideoProvider)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		provider, ok := VideoProviders[name]
+		if !ok {
+			return nil, fmt.Errorf("-pm-video-providers: unknown video provider %q, expected one of %s", name, strings.Join(videoProviderNames(), ", "))
+		}
+		providers[name] = provider
+	}
+	return providers, nil
+}
+
+// VideoEmbed is the value stored for a video field: the normalized ID of a
+// video of one of the enabled VideoProviders.
+type VideoEmbed struct {
+	Provider string `json:"provider"`
+	ID       string `json:"id"`
+}
+
+// VideoError is a video field whose value is not a video of an enabled
+// provider. It is sent to the editor as {"error": VideoError}.
+type VideoError struct {
+	Field   string `json:"field"`
+	URL     string `json:"url,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *VideoError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ParseVideoURL returns the VideoEmbed of the video at rawurl, which may be
+// any of the URLs a provider uses for a video (watch pages, short links,
+// embed URLs...). ok is false if rawurl is not a video of any of providers.
+func ParseVideoURL(providers map[string]VideoProvider, rawurl string) (embed VideoEmbed, ok bool) {
+	rawurl = strings.TrimSpace(rawurl)
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") {
+		return VideoEmbed{}, false
+	}
+	if u.Scheme == "" && !strings.HasPrefix(rawurl, "//") {
+		rawurl = "//" + rawurl
+	}
+	rawurl = rawurl[strings.Index(rawurl, "//")+2:]
+	for _, name := range videoProviderNames() {
+		provider, ok := providers[name]
+		if !ok {
+			continue
+		}
+		for _, pattern := range provider.Patterns {
+			if matches := pattern.FindStringSubmatch(rawurl); matches != nil {
+				return VideoEmbed{Provider: provider.Name, ID: matches[1]}, true
+			}
+		}
+	}
+	return VideoEmbed{}, false
+}
+
+// videoEmbed converts the value of a video field into a VideoEmbed. value is
+// either a pasted video URL or an already normalized {"provider", "id"}
+// object. ok is false for empty values.
+func (pm *PageManager) videoEmbed(field string, value interface{}) (embed VideoEmbed, ok bool, err *VideoError) {
+	switch value := value.(type) {
+	case nil:
+		return VideoEmbed{}, false, nil
+	case string:
+		if strings.TrimSpace(value) == "" {
+			return VideoEmbed{}, false, nil
+		}
+		embed, ok := ParseVideoURL(pm.videoProviders, value)
+		if !ok {
+			return VideoEmbed{}, false, &VideoError{
+				Field:   field,
+				URL:     value,
+				Message: fmt.Sprintf("%s is not a video URL of %s", value, strings.Join(pm.videoProviderNames(), ", ")),
+			}
+		}
+		return embed, true, nil
+	case map[string]interface{}:
+		embed.Provider, _ = value["provider"].(string)
+		embed.ID, _ = value["id"].(string)
+		provider, ok := pm.videoProviders[embed.Provider]
+		if !ok {
+			return VideoEmbed{}, false, &VideoError{Field: field, Message: fmt.Sprintf("%q is not one of the video providers %s", embed.Provider, strings.Join(pm.videoProviderNames(), ", "))}
+		}
+		if !provider.IDPattern.MatchString(embed.ID) {
+			return VideoEmbed{}, false, &VideoError{Field: field, Message: fmt.Sprintf("%q is not a valid %s video ID", embed.ID, embed.Provider)}
+		}
+		return embed, true, nil
+	default:
+		return VideoEmbed{}, false, &VideoError{Field: field, Message: fmt.Sprintf("expected a video URL, got a %T", value)}
+	}
+}
+
+func (pm *PageManager) videoProviderNames() []string {
+	names := make([]string, 0, len(pm.videoProviders))
+	for name := range pm.videoProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sanitizeVideo is the "video" sanitize policy: pasted video URLs are
+// stored as the VideoEmbed they point to, anything that is not a video of an
+// enabled provider is rejected with a *VideoError.
+func (pm *PageManager) sanitizeVideo(value interface{}, path string) (interface{}, error) {
+	embed, ok, verr := pm.videoEmbed(path, value)
+	if verr != nil {
+		return value, verr
+	}
+	if !ok {
+		return nil, nil
+	}
+	return map[string]interface{}{"provider": embed.Provider, "id": embed.ID}, nil
+}
+
+// videoEmbedAttr matches the data-pm.video-embed attribute that marks the
+// element a video field is embedded in, capturing the field.
+var videoEmbedAttr = regexp.MustCompile(`data-pm\.video-embed\s*=\s*["']([^"'{}]+)["']`)
+
+// videoEmbedFields returns the fields embedded as videos (marked with
+// data-pm.video-embed) in the template files, so that they get the "video"
+// sanitize policy without the theme declaring it. Files that do not exist
+// in fsys (e.g. pagemanager:: includes) are skipped.
+func videoEmbedFields(fsys fs.FS, files []string) ([]string, error) {
+	var fields []string
+	for _, file := range files {
+		if file == "" || strings.Contains(file, "::") {
+			continue
+		}
+		b, err := fs.ReadFile(fsys, file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range videoEmbedAttr.FindAllSubmatch(b, -1) {
+			fields = append(fields, strings.TrimSpace(string(match[1])))
+		}
+	}
+	return fields, nil
+}
+
+// responseWriterEnvKey is the HTML env key holding the http.ResponseWriter
+// of the current render, so that template functions can add to its headers.
+const responseWriterEnvKey = "pm.w"
+
+// responseWriterEnvFunc attaches the http.ResponseWriter (if any) of every
+// render to its HTML env.
+func (pm *PageManager) responseWriterEnvFunc(w io.Writer, r *http.Request, env map[string]interface{}) error {
+	if w, ok := w.(http.ResponseWriter); ok {
+		env[responseWriterEnvKey] = w
+	}
+	return nil
+}
+
+// renderVideoEmbed renders the iframe player of the video field value, e.g.
+//
+//	<div data-pm.video-embed="intro_video">{{ videoEmbed .Env (getValue .Env "intro_video") }}</div>
+//
+// The provider's player is added to the frame-src of the page's
+// Content-Security-Policy. Values that are empty, or that are no longer
+// videos of an enabled provider, render nothing.
+func (pm *PageManager) renderVideoEmbed(env map[string]interface{}, value interface{}, title ...string) template.HTML {
+	embed, ok, verr := pm.videoEmbed("", value)
+	if !ok || verr != nil {
+		return ""
+	}
+	provider := pm.videoProviders[embed.Provider]
+	if w, ok := env[responseWriterEnvKey].(http.ResponseWriter); ok && !renderly.ExistsCSP(w, "frame-src", provider.FrameSrc) {
+		_ = renderly.AppendCSP(w, "frame-src", provider.FrameSrc)
+	}
+	iframeTitle := provider.Name + " video"
+	if len(title) > 0 && title[0] != "" {
+		iframeTitle = title[0]
+	}
+	src := fmt.Sprintf(provider.EmbedURL, url.PathEscape(embed.ID))
+	return template.HTML(`<iframe src="` + html.EscapeString(src) + `"` +
+		` title="` + html.EscapeString(iframeTitle) + `"` +
+		` width="560" height="315" loading="lazy" frameborder="0"` +
+		` allow="accelerometer; autoplay; clipboard-write; encrypted-media; gyroscope; picture-in-picture; fullscreen"` +
+		` referrerpolicy="strict-origin-when-cross-origin"` +
+		` sandbox="allow-scripts allow-same-origin allow-presentation allow-popups"` +
+		` allowfullscreen></iframe>`)
+}
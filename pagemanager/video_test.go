@@ -0,0 +1,137 @@
+package pagemanager
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParseVideoURL(t *testing.T) {
+	tests := []struct {
+		rawurl string
+		want   VideoEmbed // zero if rawurl is not a video
+	}{
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ", VideoEmbed{"youtube", "dQw4w9WgXcQ"}},
+		{"https://www.youtube.com/watch?feature=share&v=dQw4w9WgXcQ&t=42", VideoEmbed{"youtube", "dQw4w9WgXcQ"}},
+		{"http://m.youtube.com/watch?v=dQw4w9WgXcQ", VideoEmbed{"youtube", "dQw4w9WgXcQ"}},
+		{"https://youtu.be/dQw4w9WgXcQ?si=abc", VideoEmbed{"youtube", "dQw4w9WgXcQ"}},
+		{"youtu.be/dQw4w9WgXcQ", VideoEmbed{"youtube", "dQw4w9WgXcQ"}},
+		{"https://www.youtube.com/shorts/dQw4w9WgXcQ", VideoEmbed{"youtube", "dQw4w9WgXcQ"}},
+		{"https://www.youtube-nocookie.com/embed/dQw4w9WgXcQ", VideoEmbed{"youtube", "dQw4w9WgXcQ"}},
+		{"https://vimeo.com/76979871", VideoEmbed{"vimeo", "76979871"}},
+		{"https://player.vimeo.com/video/76979871?h=1", VideoEmbed{"vimeo", "76979871"}},
+		{"https://vimeo.com/channels/staffpicks/76979871", VideoEmbed{"vimeo", "76979871"}},
+		{"https://www.dailymotion.com/video/x7tgad0", VideoEmbed{"dailymotion", "x7tgad0"}},
+		{"https://dai.ly/x7tgad0", VideoEmbed{"dailymotion", "x7tgad0"}},
+		// Not videos of an allowed provider.
+		{"", VideoEmbed{}},
+		{"https://evil.example/youtube.com/watch?v=dQw4w9WgXcQ", VideoEmbed{}},
+		{"https://youtube.com.evil.example/watch?v=dQw4w9WgXcQ", VideoEmbed{}},
+		{"https://www.youtube.com/watch?v=short", VideoEmbed{}},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ\"><script>", VideoEmbed{}},
+		{"javascript:alert(1)//youtu.be/dQw4w9WgXcQ", VideoEmbed{}},
+		{"ftp://youtu.be/dQw4w9WgXcQ", VideoEmbed{}},
+		{"https://vimeo.com/about", VideoEmbed{}},
+	}
+	for _, tt := range tests {
+		got, ok := ParseVideoURL(VideoProviders, tt.rawurl)
+		if got != tt.want || ok != (tt.want != VideoEmbed{}) {
+			t.Errorf("ParseVideoURL(%q) = %v, %v, want %v", tt.rawurl, got, ok, tt.want)
+		}
+	}
+}
+
+func TestParseVideoURLDisabledProvider(t *testing.T) {
+	providers, err := newVideoProviders("vimeo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if embed, ok := ParseVideoURL(providers, "https://youtu.be/dQw4w9WgXcQ"); ok {
+		t.Errorf("youtube is not enabled, got %v", embed)
+	}
+	if _, err := newVideoProviders("youtube,myspace"); err == nil {
+		t.Error("newVideoProviders accepted an unknown provider")
+	}
+}
+
+func TestSanitizeVideo(t *testing.T) {
+	pm := &PageManager{videoProviders: VideoProviders}
+	tests := []struct {
+		value   interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{"https://youtu.be/dQw4w9WgXcQ", map[string]interface{}{"provider": "youtube", "id": "dQw4w9WgXcQ"}, false},
+		{map[string]interface{}{"provider": "vimeo", "id": "76979871"}, map[string]interface{}{"provider": "vimeo", "id": "76979871"}, false},
+		{"", nil, false},
+		{nil, nil, false},
+		{"https://example.com/video.mp4", nil, true},
+		{map[string]interface{}{"provider": "vimeo", "id": "1\"onload=alert(1)"}, nil, true},
+		{map[string]interface{}{"provider": "myspace", "id": "1"}, nil, true},
+		{42.0, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := pm.sanitizeVideo(tt.value, "intro_video")
+		if tt.wantErr {
+			if _, ok := err.(*VideoError); !ok {
+				t.Errorf("sanitizeVideo(%v) error = %v, want a *VideoError", tt.value, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("sanitizeVideo(%v): %v", tt.value, err)
+			continue
+		}
+		if gotMap, ok := got.(map[string]interface{}); ok {
+			wantMap, _ := tt.want.(map[string]interface{})
+			if gotMap["provider"] != wantMap["provider"] || gotMap["id"] != wantMap["id"] {
+				t.Errorf("sanitizeVideo(%v) = %v, want %v", tt.value, got, tt.want)
+			}
+		} else if got != tt.want {
+			t.Errorf("sanitizeVideo(%v) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRenderVideoEmbed(t *testing.T) {
+	pm := &PageManager{videoProviders: VideoProviders}
+	got := string(pm.renderVideoEmbed(nil, map[string]interface{}{"provider": "youtube", "id": "dQw4w9WgXcQ"}, `"><script>`))
+	if !strings.Contains(got, `src="https://www.youtube-nocookie.com/embed/dQw4w9WgXcQ"`) {
+		t.Errorf("unexpected iframe src in %s", got)
+	}
+	if strings.Contains(got, "<script>") {
+		t.Errorf("title is not escaped in %s", got)
+	}
+	if got := pm.renderVideoEmbed(nil, "https://example.com/video.mp4"); got != "" {
+		t.Errorf("unsupported video rendered as %s", got)
+	}
+}
+
+func TestVideoEmbedFields(t *testing.T) {
+	fsys := fstest.MapFS{
+		"templates/theme/index.html":  {Data: []byte(`<div data-pm.video-embed="intro_video">{{ videoEmbed .Env (getValue .Env "intro_video") }}</div>`)},
+		"templates/theme/base.html":   {Data: []byte(`<div data-pm.video-embed = 'footer.video'></div><div data-pm.video-embed="{{ .Field }}"></div>`)},
+		"templates/theme/header.html": {Data: []byte(`<h1 data-pm.row-id="title"></h1>`)},
+	}
+	files := []string{"templates/theme/index.html", "templates/theme/base.html", "", "templates/theme/header.html", "templates/theme/missing.html", "pagemanager::pagemanager.js"}
+	got, err := videoEmbedFields(fsys, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "intro_video,footer.video"; strings.Join(got, ",") != want {
+		t.Errorf("got %q, want %s", got, want)
+	}
+}
+
+func TestTemplatePolicies(t *testing.T) {
+	pm := &PageManager{fsys: fstest.MapFS{
+		"templates/theme/post.html": {Data: []byte(`<h1 data-pm.row-id="title"></h1><div data-pm.video-embed="video"></div>`)},
+	}}
+	policies, err := pm.templatePolicies("templates/theme/post.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies["video"] != "video" {
+		t.Errorf("got policy %q for an embedded video field, want %q", policies["video"], "video")
+	}
+}
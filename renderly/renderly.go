@@ -308,9 +308,21 @@ func listDeps(node parse.Node) []string {
 	case *parse.TemplateNode:
 		names = append(names, node.Name)
 	case *parse.ListNode:
+		if node == nil {
+			break
+		}
 		for _, n := range node.Nodes {
 			names = append(names, listDeps(n)...)
 		}
+	case *parse.IfNode:
+		names = append(names, listDeps(node.List)...)
+		names = append(names, listDeps(node.ElseList)...)
+	case *parse.RangeNode:
+		names = append(names, listDeps(node.List)...)
+		names = append(names, listDeps(node.ElseList)...)
+	case *parse.WithNode:
+		names = append(names, listDeps(node.List)...)
+		names = append(names, listDeps(node.ElseList)...)
 	}
 	return names
 }
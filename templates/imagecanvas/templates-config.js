@@ -1,8 +1,24 @@
 return {
+  settings: {
+    id: "imagecanvas-globals",
+    fields: [
+      { name: "title", label: "Site title", type: "html", default: "My Blog" },
+      { name: "subtitle", label: "Subtitle", type: "html", default: "Where I write about <em>stuff</em>" },
+      { name: "owner", label: "Owner", type: "html", default: "Robert Table" },
+    ],
+  },
   "templates/imagecanvas/index.html": {
     include: [
       "templates/imagecanvas/index.css",
     ],
+    sanitize: {
+      "nav.title": "text",
+      "nav.link": "url",
+      "posts.date": "text",
+      "posts.title": "inline",
+      "posts.link": "url",
+      "posts.summary": "ugc",
+    },
   },
   "templates/imagecanvas/moz.html": {
     include: [